@@ -18,6 +18,7 @@ type caveatCommand struct {
 	insecure  bool
 	condition string
 	version   bakery.Version
+	namespace namespaceFlag
 }
 
 func init() {
@@ -29,7 +30,16 @@ func (c *caveatCommand) Info() *cmd.Info {
 		Name:    "caveat",
 		Args:    "macaroons condition",
 		Purpose: "Add a caveat to a macaroon",
-		Doc:     `doc TODO`,
+		Doc: `
+The caveat command adds a caveat with the given condition to
+the first of the given macaroons and prints the result.
+
+The --namespace flag registers caveat namespaces, in uri:prefix
+form, in the macaroon's namespace, so that conditions named with
+those prefixes can be interpreted by whoever checks the macaroon.
+It is an error if a URI is already registered in the macaroon
+with a different prefix.
+`,
 	}
 }
 
@@ -39,7 +49,7 @@ func (c *caveatCommand) SetFlags(f *gnuflag.FlagSet) {
 	f.Var(&c.publicKey, "public-key", "For third party caveat, base64 public key of third party (discovered automatically if not specified)")
 	f.IntVar((*int)(&c.version), "version", int(bakery.Version2), "bakery version of third party") // TODO use Version3?
 	f.BoolVar(&c.insecure, "insecure", false, "allow non-secure public key retrieval (intended only for testing)")
-	// TODO allow specification of namespace for third party caveat?
+	f.Var(&c.namespace, "namespace", "comma-separated caveat namespaces in uri:prefix form to add to the macaroon's namespace")
 }
 
 func (c *caveatCommand) IsSuperCommand() bool {
@@ -86,12 +96,15 @@ func (c *caveatCommand) Run(cmdCtx *cmd.Context) error {
 			})
 			loc = loc1
 		}
-		key1, err := bakery.GenerateKey()
+		key1, err := caveatKey(cmdCtx)
 		if err != nil {
 			return errgo.Mask(err)
 		}
 		key = key1
 	}
+	if err := c.addNamespace(c.macaroons[0]); err != nil {
+		return errgo.Mask(err)
+	}
 	if err := c.macaroons[0].AddCaveat(ctx, cav, key, loc); err != nil {
 		return errgo.Mask(err)
 	}
@@ -102,3 +115,41 @@ func (c *caveatCommand) Run(cmdCtx *cmd.Context) error {
 	cmdCtx.Stdout.Write(data)
 	return nil
 }
+
+// addNamespace registers the namespaces specified with
+// the --namespace flag in the namespace of m.
+func (c *caveatCommand) addNamespace(m *bakery.Macaroon) error {
+	if len(c.namespace.uris) == 0 {
+		return nil
+	}
+	ns := m.Namespace()
+	if ns == nil {
+		return errgo.Newf("macaroon has no namespace")
+	}
+	for _, uri := range c.namespace.uris {
+		prefix, _ := c.namespace.ns.Resolve(uri)
+		if old, ok := ns.Resolve(uri); ok {
+			if old != prefix {
+				return errgo.Newf("namespace URI %q already has prefix %q in macaroon", uri, old)
+			}
+			continue
+		}
+		ns.Register(uri, prefix)
+	}
+	return nil
+}
+
+// caveatKey returns the key to use for encrypting third party
+// caveats. This is the stored key pair if there's an access
+// token, so that the caveat ids are reproducible; otherwise
+// a new key is generated.
+func caveatKey(cmdCtx *cmd.Context) (*bakery.KeyPair, error) {
+	key, err := localKey(cmdCtx)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get key pair")
+	}
+	if key == nil {
+		return bakery.GenerateKey()
+	}
+	return key, nil
+}
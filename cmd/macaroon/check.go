@@ -2,22 +2,62 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/gnuflag"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
-	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
 )
 
 type checkCommand struct {
 	ops          []bakery.Op
 	macaroonArgs []string
+	checkersFile string
+	policyFile   string
+	now          string
+	checkCtx     params.CheckContext
+	declared     declaredFlag
+	namespace    namespaceFlag
+	any          bool
+	json         bool
+
+	externalCheckers []*externalChecker
+	policy           *policy.Policy
+
+	// checked holds the result of each condition
+	// checked by the external checkers, so that
+	// each condition is checked only once.
+	checked map[string]error
 }
 
+// Exit codes returned by the check command. Errors that
+// prevent the check from being made cause an exit code of 1,
+// and invalid arguments an exit code of 2.
+const (
+	// exitAllowed is returned when the operations are allowed.
+	exitAllowed = 0
+
+	// exitDenied is returned when the operations are not allowed.
+	exitDenied = 3
+
+	// exitUnknownConditions is returned when the operations
+	// are allowed only if the unknown conditions printed
+	// are satisfied.
+	exitUnknownConditions = 4
+)
+
 func init() {
 	register(&checkCommand{})
 }
@@ -27,12 +67,116 @@ func (c *checkCommand) Info() *cmd.Info {
 		Name:    "check",
 		Args:    "op... [macaroons...]",
 		Purpose: "Check validity of macaroons",
-		Doc:     `doc TODO`,
+		Doc: `
+The check command checks that the given macaroons allow all
+the given operations.
+
+First party caveats that are not understood by the standard
+checkers can be checked by external programs specified in the
+file given by --checkers (or the MACAROON_CHECKERS_FILE environment
+variable). The file holds a JSON array of checkers, for example:
+
+	[{
+		"prefix": "time-of-day ",
+		"command": ["/usr/local/bin/check-time-of-day"]
+	}, {
+		"namespace": "myapp",
+		"command": ["myapp", "check-caveat"]
+	}]
+
+The first checker that matches a condition is used to check it.
+A checker with a prefix matches conditions that start with the
+prefix; a checker with a namespace matches conditions whose names
+have the form prefix:name, where prefix is the prefix registered
+for the namespace URI with --namespace, or the namespace itself
+if it is not registered. The command is run with the
+condition name and argument as its last two arguments. The
+condition is allowed if it exits with a zero status; otherwise
+it is denied and anything it printed on its standard output is
+used as the reason.
+
+The --namespace flag registers caveat namespaces, in uri:prefix
+form, that are used to resolve the conditions of the standard
+and HTTP caveats as well as the namespaces of external checkers.
+It should match the namespace that the macaroons were created
+with (see "macaroon new --namespace").
+
+Conditions can also be checked against a policy file given by
+--policy, which declares the allowed arguments of custom
+conditions in YAML or JSON format, for example:
+
+	- condition: ip-in
+	  cidr: [10.0.0.0/8]
+	- condition: env
+	  values: [prod, staging]
+	- condition: user-is
+	  regexp: alice|bob
+
+A rule specifies exactly one of values (the argument must be one
+of the values), regexp (the whole argument must match the regular
+expression) or cidr (the argument, an IP address or network, must
+lie within one of the networks). A condition is allowed if any
+of the rules for it allow its argument. The policy is applied
+when the macaroons are checked, along with the standard
+checkers, so a condition that it denies causes the check to
+fail in the same way as a failed time-before caveat. When
+the macaroons are checked by a macaroond server, the policy
+is sent to the server.
+
+The --now, --client-ip and --origin flags set the time, client
+IP address and origin used to check the time-before, client-ip-addr
+and origin caveats. By default the current time is used and
+client-ip-addr caveats fail.
+
+When the check succeeds, any attributes declared by the macaroons
+are printed, one per line, prefixed with "declared: ". The
+--declared flag, which may be given several times, requires the
+macaroons to declare the given attribute in key=value form.
+When the check fails, the reason is printed on a line starting
+with "denied: ".
+
+Conditions that neither the standard checkers nor the policy
+recognize are checked by the external checkers. When a policy
+is given, conditions that remain unchecked are denied; otherwise
+they are printed, one per line, prefixed with "caveat: ".
+
+If --any is given, each operation is checked separately and
+its status is printed on a line starting with "allowed" or
+"denied", followed by any unknown conditions and declared
+attributes for the operation, indented by a tab. The check
+succeeds if any of the operations are allowed. Each condition
+is checked only once, however many operations it applies to.
+
+If --json is given, the result is printed as a JSON object
+with the following fields:
+
+	allowed            whether the operations are allowed
+	error              the reason they are not allowed
+	conditions         the first party caveat conditions evaluated
+	unknownConditions  the conditions that were not checked
+	declared           the attributes declared by the macaroons
+	ops                with --any, an array of objects holding
+	                   the above fields for each operation,
+	                   with the operation in the "op" field
+
+The exit status is 0 if the operations are allowed, 3 if they
+are not allowed, 4 if they are allowed only if the unknown
+conditions are satisfied, 2 if the arguments are invalid
+and 1 if the check could not be made.
+`,
 	}
 }
 
 func (c *checkCommand) SetFlags(f *gnuflag.FlagSet) {
-	// TODO allow a namespace to be specified.
+	f.Var(&c.namespace, "namespace", "comma-separated caveat namespaces in uri:prefix form used to resolve conditions")
+	f.StringVar(&c.checkersFile, "checkers", os.Getenv(envCheckersFile), "file holding external caveat checkers in JSON format (defaults to $"+envCheckersFile+")")
+	f.StringVar(&c.policyFile, "policy", "", "file holding caveat policy in YAML or JSON format")
+	f.StringVar(&c.now, "now", "", "time to check time-before caveats against, in RFC3339 format (defaults to the current time)")
+	f.StringVar(&c.checkCtx.ClientIPAddr, "client-ip", "", "client IP address to check client-ip-addr caveats against")
+	f.StringVar(&c.checkCtx.Origin, "origin", "", "origin to check origin caveats against")
+	f.Var(&c.declared, "declared", "attribute in key=value form that the macaroons must declare (may be repeated)")
+	f.BoolVar(&c.any, "any", false, "check each operation separately and print the status of each")
+	f.BoolVar(&c.json, "json", false, "print the result in JSON format")
 }
 
 func (c *checkCommand) Init(args []string) error {
@@ -52,11 +196,36 @@ func (c *checkCommand) Init(args []string) error {
 	if len(c.ops) == 0 {
 		return errgo.Newf("no operations specified")
 	}
+	if c.now != "" {
+		t, err := time.Parse(time.RFC3339, c.now)
+		if err != nil {
+			return errgo.Notef(err, "invalid --now value")
+		}
+		c.checkCtx.Now = t
+	}
+	if c.checkCtx.ClientIPAddr != "" && net.ParseIP(c.checkCtx.ClientIPAddr) == nil {
+		return errgo.Newf("invalid --client-ip value %q", c.checkCtx.ClientIPAddr)
+	}
 	return nil
 }
 
 func (c *checkCommand) Run(cmdCtx *cmd.Context) error {
 	ctx := context.Background()
+	if c.checkersFile != "" {
+		ecs, err := readExternalCheckers(cmdCtx.AbsPath(c.checkersFile))
+		if err != nil {
+			return errgo.Notef(err, "cannot read checkers")
+		}
+		c.externalCheckers = ecs
+		c.checked = make(map[string]error)
+	}
+	if c.policyFile != "" {
+		pol, err := policy.ReadFile(cmdCtx.AbsPath(c.policyFile))
+		if err != nil {
+			return errgo.Notef(err, "cannot read policy")
+		}
+		c.policy = pol
+	}
 	var mss []macaroon.Slice
 	for i, arg := range c.macaroonArgs {
 		bms, ms, err := parseEither(arg)
@@ -70,34 +239,111 @@ func (c *checkCommand) Run(cmdCtx *cmd.Context) error {
 		}
 		mss = append(mss, ms)
 	}
-	// TODO provide more first party caveat checkers, and the facility to invoke
-	// commands to check caveats.
-	fpChecker := &firstPartyChecker{
-		underlying: checkers.New(nil),
-	}
-	oven, err := newOven(cmdCtx)
+	oven, err := newOven(cmdCtx, c.namespace.ns, true)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	checker := bakery.NewChecker(bakery.CheckerParams{
-		MacaroonOpStore: oven,
-		Checker:         fpChecker,
-	}).Auth(mss...)
-	if checker.FirstPartyCaveatChecker != fpChecker {
-		panic(errgo.Newf("unexpected checker %T", checker.FirstPartyCaveatChecker))
+	var result checkResult
+	if c.any {
+		statuses, err := oven.CheckOps(ctx, mss, c.ops, c.checkCtx, c.policy)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i := range statuses {
+			if err := c.evaluate(ctx, cmdCtx.Stderr, &statuses[i]); err != nil {
+				return errgo.Mask(err)
+			}
+			if statuses[i].Allowed {
+				result.Allowed = true
+			}
+		}
+		result.Ops = statuses
+	} else {
+		var status params.OpStatus
+		resp, err := oven.CheckMacaroons(ctx, mss, c.ops, c.checkCtx, c.policy)
+		switch {
+		case err == nil:
+			status.Allowed = true
+			status.Conditions = resp.Conditions
+			status.UnknownConditions = resp.UnknownConditions
+			status.Declared = resp.Declared
+		case errgo.Cause(err) == params.ErrVerificationFailed:
+			status.Error = err.Error()
+		default:
+			return errgo.Mask(err)
+		}
+		if err := c.evaluate(ctx, cmdCtx.Stderr, &status); err != nil {
+			return errgo.Mask(err)
+		}
+		result = checkResult{
+			Allowed:           status.Allowed,
+			Error:             status.Error,
+			Conditions:        status.Conditions,
+			UnknownConditions: status.UnknownConditions,
+			Declared:          status.Declared,
+		}
 	}
-	if _, err := checker.Allow(ctx, c.ops...); err != nil {
-		return errgo.Mask(err)
+	if c.json {
+		data, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Fprintf(cmdCtx.Stdout, "%s\n", data)
+	} else {
+		result.writeText(cmdCtx.Stdout)
+	}
+	if code := result.exitCode(); code != exitAllowed {
+		return cmd.NewRcPassthroughError(code)
 	}
-	if len(fpChecker.unknownConditions) == 0 {
+	return nil
+}
+
+// evaluate checks the unknown conditions in the given status
+// with the external checkers, and checks the
+// declared attributes against those required by the --declared
+// flag. If a check fails, the status is updated to show that the
+// operations are not allowed. Conditions that remain unchecked
+// are left in status.UnknownConditions. Anything printed by the
+// external checkers on their standard error is written to stderr.
+func (c *checkCommand) evaluate(ctx context.Context, stderr io.Writer, status *params.OpStatus) error {
+	if !status.Allowed {
 		return nil
 	}
-	for _, cond := range fpChecker.unknownConditions {
-		fmt.Fprintf(cmdCtx.Stdout, "caveat: %s\n", cond)
+	conditions, err := c.checkConditions(ctx, stderr, status)
+	if err != nil {
+		if errgo.Cause(err) != errCaveatDenied {
+			return errgo.Mask(err)
+		}
+		status.Allowed = false
+		status.Error = err.Error()
+		return nil
 	}
+	status.UnknownConditions = conditions
 	return nil
 }
 
+// checkConditions implements the checks for evaluate, returning
+// the conditions that remain unchecked. If a check fails, the
+// returned error has an errCaveatDenied cause.
+func (c *checkCommand) checkConditions(ctx context.Context, stderr io.Writer, status *params.OpStatus) ([]string, error) {
+	for key, val := range c.declared {
+		if got, ok := status.Declared[key]; !ok || got != val {
+			return nil, errgo.WithCausef(nil, errCaveatDenied, "macaroons do not declare %s=%s", key, val)
+		}
+	}
+	conditions, err := checkConditions(ctx, c.externalCheckers, c.namespace.ns, status.UnknownConditions, c.checked, stderr)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errCaveatDenied))
+	}
+	if c.policy != nil && len(conditions) > 0 {
+		// The policy has already been applied when checking
+		// the macaroons, so any conditions that remain are
+		// unknown to it. Fail closed.
+		return nil, errgo.WithCausef(nil, errCaveatDenied, "caveat %q not allowed by policy", conditions[0])
+	}
+	return conditions, nil
+}
+
 func (c *checkCommand) IsSuperCommand() bool {
 	return false
 }
@@ -106,25 +352,113 @@ func (c *checkCommand) AllowInterspersedFlags() bool {
 	return false
 }
 
-// firstPartyChecker wraps a bakery.FirstPartyCaveatChecker by
-// appending any unknown caveats to unknownCaveats.
-type firstPartyChecker struct {
-	unknownConditions []string
-	underlying        bakery.FirstPartyCaveatChecker
+// declaredFlag implements gnuflag.Value by adding
+// an attribute in key=value form for each use of the flag.
+type declaredFlag map[string]string
+
+func (f *declaredFlag) String() string {
+	keys := make([]string, 0, len(*f))
+	for key := range *f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s := make([]string, len(keys))
+	for i, key := range keys {
+		s[i] = key + "=" + (*f)[key]
+	}
+	return strings.Join(s, ",")
 }
 
-func (c *firstPartyChecker) CheckFirstPartyCaveat(ctx context.Context, cav string) error {
-	err := c.underlying.CheckFirstPartyCaveat(ctx, cav)
-	if err == nil {
-		return nil
+func (f *declaredFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return errgo.Newf("invalid declared attribute %q (must be in key=value form)", s)
 	}
-	if errgo.Cause(err) == checkers.ErrCaveatNotRecognized {
-		c.unknownConditions = append(c.unknownConditions, cav)
-		return nil
+	if *f == nil {
+		*f = make(declaredFlag)
+	}
+	(*f)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// checkResult holds the result of the check command,
+// as printed with the --json flag.
+type checkResult struct {
+	// Allowed holds whether the operations are allowed,
+	// or with --any, whether any of the operations are allowed.
+	Allowed bool `json:"allowed"`
+
+	// Error holds the reason the operations are not allowed.
+	Error string `json:"error,omitempty"`
+
+	Conditions        []string          `json:"conditions,omitempty"`
+	UnknownConditions []string          `json:"unknownConditions,omitempty"`
+	Declared          map[string]string `json:"declared,omitempty"`
+
+	// Ops holds the status of each operation with --any.
+	Ops []params.OpStatus `json:"ops,omitempty"`
+}
+
+// exitCode returns the exit code for the result.
+func (r *checkResult) exitCode() int {
+	if r.Ops == nil {
+		return statusExitCode(r.Allowed, r.UnknownConditions)
+	}
+	code := exitDenied
+	for _, status := range r.Ops {
+		switch statusExitCode(status.Allowed, status.UnknownConditions) {
+		case exitAllowed:
+			return exitAllowed
+		case exitUnknownConditions:
+			code = exitUnknownConditions
+		}
+	}
+	return code
+}
+
+func statusExitCode(allowed bool, unknownConditions []string) int {
+	switch {
+	case !allowed:
+		return exitDenied
+	case len(unknownConditions) > 0:
+		return exitUnknownConditions
 	}
-	return errgo.Mask(err, errgo.Is(checkers.ErrCaveatNotRecognized))
+	return exitAllowed
 }
 
-func (c *firstPartyChecker) Namespace() *checkers.Namespace {
-	return c.underlying.Namespace()
+// writeText writes the result to w in text form.
+func (r *checkResult) writeText(w io.Writer) {
+	if r.Ops == nil {
+		if !r.Allowed {
+			fmt.Fprintf(w, "denied: %s\n", r.Error)
+			return
+		}
+		writeConditions(w, "", r.UnknownConditions, r.Declared)
+		return
+	}
+	for _, status := range r.Ops {
+		op := status.Op.Action + ":" + status.Op.Entity
+		if !status.Allowed {
+			fmt.Fprintf(w, "denied %s: %s\n", op, status.Error)
+			continue
+		}
+		fmt.Fprintf(w, "allowed %s\n", op)
+		writeConditions(w, "\t", status.UnknownConditions, status.Declared)
+	}
+}
+
+// writeConditions writes the given unknown conditions and
+// declared attributes to w, one per line, with the given indent.
+func writeConditions(w io.Writer, indent string, unknownConditions []string, declared map[string]string) {
+	for _, cond := range unknownConditions {
+		fmt.Fprintf(w, "%scaveat: %s\n", indent, cond)
+	}
+	keys := make([]string, 0, len(declared))
+	for key := range declared {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%sdeclared: %s=%s\n", indent, key, declared[key])
+	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
+)
+
+func TestEvaluatePolicyFailsClosed(t *testing.T) {
+	c := qt.New(t)
+	sh := shellPath(c)
+	pol, err := policy.New([]policy.Rule{{
+		Condition: "env",
+		Values:    []string{"prod"},
+	}})
+	c.Assert(err, qt.Equals, nil)
+	cmd := &checkCommand{
+		externalCheckers: []*externalChecker{{
+			Prefix:  "ok-",
+			Command: []string{sh, "-c", checkerScript, "checker"},
+		}},
+	}
+
+	// Without a policy, conditions that no external checker
+	// applies to are left for the caller.
+	status := &params.OpStatus{
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond yes", "other"},
+	}
+	err = cmd.evaluate(context.Background(), ioutil.Discard, status)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(status.Allowed, qt.Equals, true)
+	c.Assert(status.UnknownConditions, qt.DeepEquals, []string{"other"})
+
+	// With a policy, they are denied.
+	cmd.policy = pol
+	status = &params.OpStatus{
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond yes", "other"},
+	}
+	err = cmd.evaluate(context.Background(), ioutil.Discard, status)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(status.Allowed, qt.Equals, false)
+	c.Assert(status.Error, qt.Equals, `caveat "other" not allowed by policy`)
+
+	// Conditions allowed by external checkers are
+	// still allowed.
+	status = &params.OpStatus{
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond yes"},
+	}
+	err = cmd.evaluate(context.Background(), ioutil.Discard, status)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(status.Allowed, qt.Equals, true)
+	c.Assert(status.UnknownConditions, qt.HasLen, 0)
+}
+
+func TestEvaluateChecksConditionsOnce(t *testing.T) {
+	c := qt.New(t)
+	sh := shellPath(c)
+	cmd := &checkCommand{
+		externalCheckers: []*externalChecker{{
+			Prefix:  "ok-",
+			Command: []string{sh, "-c", checkerScript, "checker"},
+		}},
+		checked: make(map[string]error),
+	}
+	var stderr bytes.Buffer
+	statuses := []params.OpStatus{{
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond yes"},
+	}, {
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond yes", "ok-cond no"},
+	}, {
+		Allowed:           true,
+		UnknownConditions: []string{"ok-cond no"},
+	}}
+	for i := range statuses {
+		err := cmd.evaluate(context.Background(), &stderr, &statuses[i])
+		c.Assert(err, qt.Equals, nil)
+	}
+	c.Assert(stderr.String(), qt.Equals, "ok-cond yes\nok-cond no\n")
+	c.Assert(statuses[0].Allowed, qt.Equals, true)
+	c.Assert(statuses[1].Allowed, qt.Equals, false)
+	c.Assert(statuses[1].Error, qt.Equals, `caveat "ok-cond no" denied: not no`)
+	c.Assert(statuses[2].Allowed, qt.Equals, false)
+	c.Assert(statuses[2].Error, qt.Equals, `caveat "ok-cond no" denied: not no`)
+}
+
+var (
+	readOp = bakery.Op{
+		Entity: "foo",
+		Action: "read",
+	}
+	writeOp = bakery.Op{
+		Entity: "foo",
+		Action: "write",
+	}
+)
+
+var checkResultTests = []struct {
+	about          string
+	result         checkResult
+	expectExitCode int
+	expectJSON     string
+	expectText     string
+}{{
+	about: "allowed",
+	result: checkResult{
+		Allowed:    true,
+		Conditions: []string{"time-before 2030-01-01T00:00:00Z", "declared user bob"},
+		Declared: map[string]string{
+			"user": "bob",
+		},
+	},
+	expectExitCode: exitAllowed,
+	expectJSON: `{
+		"allowed": true,
+		"conditions": ["time-before 2030-01-01T00:00:00Z", "declared user bob"],
+		"declared": {"user": "bob"}
+	}`,
+	expectText: "declared: user=bob\n",
+}, {
+	about: "allowed with unknown conditions",
+	result: checkResult{
+		Allowed:           true,
+		Conditions:        []string{"foo", "bar"},
+		UnknownConditions: []string{"foo", "bar"},
+	},
+	expectExitCode: exitUnknownConditions,
+	expectJSON: `{
+		"allowed": true,
+		"conditions": ["foo", "bar"],
+		"unknownConditions": ["foo", "bar"]
+	}`,
+	expectText: "caveat: foo\ncaveat: bar\n",
+}, {
+	about: "denied",
+	result: checkResult{
+		Error: "permission denied",
+	},
+	expectExitCode: exitDenied,
+	expectJSON: `{
+		"allowed": false,
+		"error": "permission denied"
+	}`,
+	expectText: "denied: permission denied\n",
+}, {
+	about: "any with one allowed operation",
+	result: checkResult{
+		Allowed: true,
+		Ops: []params.OpStatus{{
+			Op:    readOp,
+			Error: "permission denied",
+		}, {
+			Op:         writeOp,
+			Allowed:    true,
+			Conditions: []string{"declared user bob"},
+			Declared: map[string]string{
+				"user": "bob",
+			},
+		}},
+	},
+	expectExitCode: exitAllowed,
+	expectJSON: `{
+		"allowed": true,
+		"ops": [{
+			"op": {"Entity": "foo", "Action": "read"},
+			"allowed": false,
+			"error": "permission denied"
+		}, {
+			"op": {"Entity": "foo", "Action": "write"},
+			"allowed": true,
+			"conditions": ["declared user bob"],
+			"declared": {"user": "bob"}
+		}]
+	}`,
+	expectText: "denied read:foo: permission denied\nallowed write:foo\n\tdeclared: user=bob\n",
+}, {
+	about: "any with unknown conditions",
+	result: checkResult{
+		Allowed: true,
+		Ops: []params.OpStatus{{
+			Op:                readOp,
+			Allowed:           true,
+			Conditions:        []string{"foo"},
+			UnknownConditions: []string{"foo"},
+		}, {
+			Op:    writeOp,
+			Error: "permission denied",
+		}},
+	},
+	expectExitCode: exitUnknownConditions,
+	expectJSON: `{
+		"allowed": true,
+		"ops": [{
+			"op": {"Entity": "foo", "Action": "read"},
+			"allowed": true,
+			"conditions": ["foo"],
+			"unknownConditions": ["foo"]
+		}, {
+			"op": {"Entity": "foo", "Action": "write"},
+			"allowed": false,
+			"error": "permission denied"
+		}]
+	}`,
+	expectText: "allowed read:foo\n\tcaveat: foo\ndenied write:foo: permission denied\n",
+}, {
+	about: "any with no allowed operations",
+	result: checkResult{
+		Ops: []params.OpStatus{{
+			Op:    readOp,
+			Error: "permission denied",
+		}, {
+			Op:    writeOp,
+			Error: `caveat "foo" denied: no`,
+		}},
+	},
+	expectExitCode: exitDenied,
+	expectJSON: `{
+		"allowed": false,
+		"ops": [{
+			"op": {"Entity": "foo", "Action": "read"},
+			"allowed": false,
+			"error": "permission denied"
+		}, {
+			"op": {"Entity": "foo", "Action": "write"},
+			"allowed": false,
+			"error": "caveat \"foo\" denied: no"
+		}]
+	}`,
+	expectText: "denied read:foo: permission denied\ndenied write:foo: caveat \"foo\" denied: no\n",
+}}
+
+func TestCheckResult(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkResultTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.result.exitCode(), qt.Equals, test.expectExitCode)
+
+			data, err := json.Marshal(test.result)
+			c.Assert(err, qt.Equals, nil)
+			var got, expect interface{}
+			err = json.Unmarshal(data, &got)
+			c.Assert(err, qt.Equals, nil)
+			err = json.Unmarshal([]byte(test.expectJSON), &expect)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(got, qt.DeepEquals, expect)
+
+			var buf bytes.Buffer
+			test.result.writeText(&buf)
+			c.Assert(buf.String(), qt.Equals, test.expectText)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+// envCheckersFile holds the path to the default
+// external checker configuration file.
+const envCheckersFile = "MACAROON_CHECKERS_FILE"
+
+// errCaveatDenied is used as the cause of errors returned
+// when an external checker denies a caveat.
+var errCaveatDenied = errgo.New("caveat denied")
+
+// externalChecker holds a rule from the checker configuration
+// file. It maps caveat conditions to a program that checks them.
+type externalChecker struct {
+	// Prefix holds a prefix of the conditions that the
+	// checker applies to.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Namespace holds the namespace of the conditions
+	// that the checker applies to. It is resolved to a
+	// prefix with the namespace given to checkConditions,
+	// or used as the prefix itself if it isn't registered there.
+	// A condition is in the namespace if its name has the
+	// form prefix:name.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Command holds the program to run and any
+	// initial arguments.
+	Command []string `json:"command"`
+}
+
+// readExternalCheckers reads the external checker
+// configuration from the given file.
+func readExternalCheckers(path string) ([]*externalChecker, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var ecs []*externalChecker
+	if err := json.Unmarshal(data, &ecs); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
+	for i, ec := range ecs {
+		if (ec.Prefix == "") == (ec.Namespace == "") {
+			return nil, errgo.Newf("checker %d must specify exactly one of prefix or namespace", i)
+		}
+		if len(ec.Command) == 0 {
+			return nil, errgo.Newf("no command in checker %d", i)
+		}
+	}
+	return ecs, nil
+}
+
+// matches reports whether the checker applies to the given condition.
+// The namespace ns, which may be nil, is used to resolve
+// ec.Namespace.
+func (ec *externalChecker) matches(ns *checkers.Namespace, cond string) bool {
+	if ec.Prefix != "" {
+		return strings.HasPrefix(cond, ec.Prefix)
+	}
+	prefix, ok := ns.Resolve(ec.Namespace)
+	if !ok {
+		prefix = ec.Namespace
+	}
+	name, _, err := checkers.ParseCaveat(cond)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(name, prefix+":")
+}
+
+// check runs the checker's command to check the given condition.
+// The condition's name and argument are passed as the final two
+// arguments to the command. The condition is allowed if the command
+// exits with a zero status; otherwise the returned error has an
+// errCaveatDenied cause and holds the reason printed by the command
+// on its standard output. Anything printed to standard error is
+// written to stderr.
+func (ec *externalChecker) check(ctx context.Context, cond string, stderr io.Writer) error {
+	name, arg, err := checkers.ParseCaveat(cond)
+	if err != nil {
+		return errgo.WithCausef(err, errCaveatDenied, "")
+	}
+	args := append(ec.Command[1:len(ec.Command):len(ec.Command)], name, arg)
+	cmd := exec.CommandContext(ctx, ec.Command[0], args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		return errgo.Notef(err, "cannot run checker for %q", cond)
+	}
+	reason := strings.TrimSpace(out.String())
+	if reason == "" {
+		reason = err.Error()
+	}
+	return errgo.WithCausef(nil, errCaveatDenied, "caveat %q denied: %s", cond, reason)
+}
+
+// checkConditions checks each of the given conditions with the
+// first external checker that matches it, resolving checker
+// namespaces with ns, which may be nil. It returns the conditions
+// that no checker applies to. If any condition is denied, it returns
+// an error with an errCaveatDenied cause.
+//
+// If results is non-nil, the result of checking each condition
+// is recorded in it, and conditions that it already holds are
+// not checked again.
+func checkConditions(ctx context.Context, ecs []*externalChecker, ns *checkers.Namespace, conds []string, results map[string]error, stderr io.Writer) ([]string, error) {
+	var unchecked []string
+	for _, cond := range conds {
+		ec := findExternalChecker(ecs, ns, cond)
+		if ec == nil {
+			unchecked = append(unchecked, cond)
+			continue
+		}
+		err, ok := results[cond]
+		if !ok {
+			err = ec.check(ctx, cond, stderr)
+			if err != nil && errgo.Cause(err) != errCaveatDenied {
+				return nil, errgo.Mask(err)
+			}
+			if results != nil {
+				results[cond] = err
+			}
+		}
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(errCaveatDenied))
+		}
+	}
+	return unchecked, nil
+}
+
+// findExternalChecker returns the first checker that matches
+// the given condition, or nil if there is none.
+func findExternalChecker(ecs []*externalChecker, ns *checkers.Namespace, cond string) *externalChecker {
+	for _, ec := range ecs {
+		if ec.matches(ns, cond) {
+			return ec
+		}
+	}
+	return nil
+}
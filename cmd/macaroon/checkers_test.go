@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+var readExternalCheckersTests = []struct {
+	about       string
+	spec        string
+	expectError string
+}{{
+	about: "valid checkers",
+	spec: `[{
+		"prefix": "ip ",
+		"command": ["check-ip"]
+	}, {
+		"namespace": "example.com/auth",
+		"command": ["check-auth", "-v"]
+	}]`,
+}, {
+	about:       "invalid JSON",
+	spec:        `[{"prefix": "x"`,
+	expectError: `cannot parse ".*": .*`,
+}, {
+	about:       "neither prefix nor namespace",
+	spec:        `[{"prefix": "x", "command": ["a"]}, {"command": ["a"]}]`,
+	expectError: `checker 1 must specify exactly one of prefix or namespace`,
+}, {
+	about:       "both prefix and namespace",
+	spec:        `[{"prefix": "x", "namespace": "y", "command": ["a"]}]`,
+	expectError: `checker 0 must specify exactly one of prefix or namespace`,
+}, {
+	about:       "no command",
+	spec:        `[{"prefix": "x", "command": []}]`,
+	expectError: `no command in checker 0`,
+}}
+
+func TestReadExternalCheckers(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroon-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkers.json")
+	for _, test := range readExternalCheckersTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := ioutil.WriteFile(path, []byte(test.spec), 0666)
+			c.Assert(err, qt.Equals, nil)
+			ecs, err := readExternalCheckers(path)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(ecs, qt.DeepEquals, []*externalChecker{{
+				Prefix:  "ip ",
+				Command: []string{"check-ip"},
+			}, {
+				Namespace: "example.com/auth",
+				Command:   []string{"check-auth", "-v"},
+			}})
+		})
+	}
+}
+
+var externalCheckerMatchesTests = []struct {
+	about   string
+	checker externalChecker
+	cond    string
+	expect  bool
+}{{
+	about:   "prefix match",
+	checker: externalChecker{Prefix: "ip "},
+	cond:    "ip 10.0.0.1",
+	expect:  true,
+}, {
+	about:   "prefix mismatch",
+	checker: externalChecker{Prefix: "ip "},
+	cond:    "ipaddr 10.0.0.1",
+}, {
+	about:   "prefix matches unparsed condition",
+	checker: externalChecker{Prefix: "auth:"},
+	cond:    "auth:user bob",
+	expect:  true,
+}, {
+	about:   "registered namespace",
+	checker: externalChecker{Namespace: "example.com/auth"},
+	cond:    "auth:user bob",
+	expect:  true,
+}, {
+	about:   "registered namespace does not match its URI as a prefix",
+	checker: externalChecker{Namespace: "example.com/auth"},
+	cond:    "example.com/auth:user bob",
+}, {
+	about:   "unregistered namespace is used as the prefix",
+	checker: externalChecker{Namespace: "other"},
+	cond:    "other:user bob",
+	expect:  true,
+}, {
+	about:   "namespace matches only whole prefixes",
+	checker: externalChecker{Namespace: "other"},
+	cond:    "otherx:user bob",
+}, {
+	about:   "namespace does not match the argument",
+	checker: externalChecker{Namespace: "other"},
+	cond:    "user other:bob",
+}}
+
+func TestExternalCheckerMatches(t *testing.T) {
+	c := qt.New(t)
+	ns := checkers.NewNamespace(map[string]string{
+		"example.com/auth": "auth",
+	})
+	for _, test := range externalCheckerMatchesTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.checker.matches(ns, test.cond), qt.Equals, test.expect)
+		})
+	}
+}
+
+// checkerScript holds a shell script used as an external checker.
+// It allows the "ok" condition, prints its arguments to
+// stderr and denies anything else, printing the reason to stdout.
+const checkerScript = `
+echo "$@" >&2
+if [ "$1 $2" = "ok-cond yes" ]; then exit 0; fi
+echo "not $2"
+exit 1
+`
+
+func TestExternalCheckerCheck(t *testing.T) {
+	c := qt.New(t)
+	sh := shellPath(c)
+	ec := &externalChecker{
+		Prefix:  "ok-cond",
+		Command: []string{sh, "-c", checkerScript, "checker"},
+	}
+	var stderr bytes.Buffer
+	err := ec.check(context.Background(), "ok-cond yes", &stderr)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(stderr.String(), qt.Equals, "ok-cond yes\n")
+
+	err = ec.check(context.Background(), "ok-cond no", &stderr)
+	c.Assert(err, qt.ErrorMatches, `caveat "ok-cond no" denied: not no`)
+	c.Assert(errgo.Cause(err), qt.Equals, errCaveatDenied)
+
+	// When the checker prints no reason, the exit status is used.
+	ec.Command = []string{sh, "-c", "exit 3"}
+	err = ec.check(context.Background(), "ok-cond yes", &stderr)
+	c.Assert(err, qt.ErrorMatches, `caveat "ok-cond yes" denied: exit status 3`)
+	c.Assert(errgo.Cause(err), qt.Equals, errCaveatDenied)
+
+	// A checker that cannot be run is an error, not a denial.
+	ec.Command = []string{filepath.Join(c.Mkdir(), "nonexistent")}
+	err = ec.check(context.Background(), "ok-cond yes", &stderr)
+	c.Assert(err, qt.ErrorMatches, `cannot run checker for "ok-cond yes": .*`)
+	c.Assert(errgo.Cause(err), qt.Not(qt.Equals), errCaveatDenied)
+}
+
+func TestCheckConditions(t *testing.T) {
+	c := qt.New(t)
+	sh := shellPath(c)
+	ecs := []*externalChecker{{
+		Prefix:  "ok-",
+		Command: []string{sh, "-c", checkerScript, "checker"},
+	}}
+	unchecked, err := checkConditions(context.Background(), ecs, nil, []string{
+		"ok-cond yes",
+		"other",
+	}, nil, ioutil.Discard)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(unchecked, qt.DeepEquals, []string{"other"})
+
+	_, err = checkConditions(context.Background(), ecs, nil, []string{
+		"ok-cond yes",
+		"ok-cond no",
+		"other",
+	}, nil, ioutil.Discard)
+	c.Assert(err, qt.ErrorMatches, `caveat "ok-cond no" denied: not no`)
+	c.Assert(errgo.Cause(err), qt.Equals, errCaveatDenied)
+}
+
+func TestCheckConditionsRecordsResults(t *testing.T) {
+	c := qt.New(t)
+	sh := shellPath(c)
+	ecs := []*externalChecker{{
+		Prefix:  "ok-",
+		Command: []string{sh, "-c", checkerScript, "checker"},
+	}}
+	results := make(map[string]error)
+	var stderr bytes.Buffer
+	for i := 0; i < 2; i++ {
+		unchecked, err := checkConditions(context.Background(), ecs, nil, []string{
+			"ok-cond yes",
+			"other",
+		}, results, &stderr)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(unchecked, qt.DeepEquals, []string{"other"})
+		_, err = checkConditions(context.Background(), ecs, nil, []string{
+			"ok-cond no",
+		}, results, &stderr)
+		c.Assert(err, qt.ErrorMatches, `caveat "ok-cond no" denied: not no`)
+		c.Assert(errgo.Cause(err), qt.Equals, errCaveatDenied)
+	}
+	// The checker has been run only once for each condition.
+	c.Assert(stderr.String(), qt.Equals, "ok-cond yes\nok-cond no\n")
+	c.Assert(results, qt.HasLen, 2)
+}
+
+// shellPath returns the path to sh, skipping the
+// test if it is not available.
+func shellPath(c *qt.C) string {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		c.Skip("sh not available")
+	}
+	return sh
+}
@@ -5,14 +5,19 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
 	"github.com/juju/loggo"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
-	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	"gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/cmd/macaroond/macaroondclient"
+	"github.com/rogpeppe/macaroon-cmd/params"
 )
 
 var logger = loggo.GetLogger("macaroon-cmd")
@@ -23,36 +28,52 @@ var logger = loggo.GetLogger("macaroon-cmd")
 // between operations and macaroons.
 const unboundPrefix = "unbound%"
 
-func newOven(ctx *cmd.Context) (*bakery.Oven, error) {
-	rks, err := newRootKeyStore()
-	if err != nil {
-		return nil, errgo.Mask(err)
+// serverFlags holds the flags that specify how
+// to connect to the macaroond server.
+type serverFlags struct {
+	server macaroondclient.Params
+}
+
+func (f *serverFlags) SetFlags(fs *gnuflag.FlagSet) {
+	fs.StringVar(&f.server.Network, "t", params.DefaultNetwork, "network to use to connect to server (unix, tcp or tls)")
+	fs.StringVar(&f.server.Addr, "addr", params.DefaultAddress, "address or socket path to connect to")
+	fs.StringVar(&f.server.CACert, "ca", "", "PEM file holding CA certificates to trust (tls network only)")
+	fs.StringVar(&f.server.ClientCert, "cert", "", "PEM file holding the client certificate (tls network only)")
+	fs.StringVar(&f.server.ClientKey, "key", "", "PEM file holding the client private key (tls network only)")
+}
+
+// absParams returns the server parameters with all
+// file paths made absolute, so that they remain valid
+// when recorded in an access token.
+func (f *serverFlags) absParams() (macaroondclient.Params, error) {
+	p := f.server
+	for _, path := range []*string{&p.CACert, &p.ClientCert, &p.ClientKey} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return macaroondclient.Params{}, errgo.Mask(err)
+		}
+		*path = abs
 	}
-	return bakery.NewOven(bakery.OvenParams{
-		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
-			return rks
-		},
-		// TODO Namespace
-		// TODO OpsStore - store the ops in the server too
-		// TODO Key - store the key in the server too
-		Locator: httpbakery.NewThirdPartyLocator(nil, nil),
-	}), nil
+	return p, nil
 }
 
 func parseOp(s string) (bakery.Op, error) {
 	p := strings.SplitN(s, ":", 2)
 	if len(p) < 2 {
-		return bakery.Op{}, errgo.Newf("invalid operation %q (must be in action:entity form)")
+		return bakery.Op{}, errgo.Newf("invalid operation %q (must be in action:entity form)", s)
 	}
 	op := bakery.Op{
 		Entity: p[1],
 		Action: p[0],
 	}
 	if op.Entity == "" {
-		return bakery.Op{}, errgo.Newf("operation %q has empty entity")
+		return bakery.Op{}, errgo.Newf("operation %q has empty entity", s)
 	}
 	if op.Action == "" {
-		return bakery.Op{}, errgo.Newf("operation %q has empty action")
+		return bakery.Op{}, errgo.Newf("operation %q has empty action", s)
 	}
 	return op, nil
 }
@@ -163,9 +184,53 @@ func (f *publicKeyFlag) Set(s string) error {
 	return nil
 }
 
+// namespaceFlag implements gnuflag.Value by registering
+// comma-separated namespace URIs and their prefixes
+// in uri:prefix form. The flag may be used several times.
+type namespaceFlag struct {
+	ns *checkers.Namespace
+	// uris holds the registered URIs in the order
+	// they were specified.
+	uris []string
+}
+
+func (f *namespaceFlag) String() string {
+	if f.ns == nil {
+		return ""
+	}
+	return strings.Replace(f.ns.String(), " ", ",", -1)
+}
+
+func (f *namespaceFlag) Set(s string) error {
+	if f.ns == nil {
+		f.ns = checkers.NewNamespace(nil)
+	}
+	for _, elem := range strings.Split(s, ",") {
+		i := strings.LastIndex(elem, ":")
+		if i <= 0 {
+			return errgo.Newf("invalid namespace %q (must be in uri:prefix form)", elem)
+		}
+		uri, prefix := elem[:i], elem[i+1:]
+		if !checkers.IsValidSchemaURI(uri) {
+			return errgo.Newf("invalid namespace URI %q", uri)
+		}
+		if !checkers.IsValidPrefix(prefix) {
+			return errgo.Newf("invalid namespace prefix %q", prefix)
+		}
+		if old, ok := f.ns.Resolve(uri); ok && old != prefix {
+			return errgo.Newf("namespace URI %q registered with prefixes %q and %q", uri, old, prefix)
+		} else if !ok {
+			f.uris = append(f.uris, uri)
+		}
+		f.ns.Register(uri, prefix)
+	}
+	return nil
+}
+
 const (
 	formatJSON formatFlag = iota
 	formatBinary
+	formatText
 
 	formatRaw formatFlag = 1 << 3
 )
@@ -179,6 +244,8 @@ func (f formatFlag) String() string {
 		s = "json"
 	case formatBinary:
 		s = "binary"
+	case formatText:
+		s = "text"
 	default:
 		s = "unknown"
 	}
@@ -199,6 +266,11 @@ func (f *formatFlag) Set(s string) error {
 		fv |= formatJSON
 	case "binary":
 		fv |= formatBinary
+	case "text":
+		if fv&formatRaw != 0 {
+			return errgo.Newf("unrecognized format %q", s)
+		}
+		fv |= formatText
 	default:
 		return errgo.Newf("unrecognized format %q", s)
 	}
@@ -222,6 +294,8 @@ func (f formatFlag) marshalUnbound(ms bakery.Slice) ([]byte, error) {
 		}
 	case formatBinary:
 		return nil, errgo.Newf("cannot format unbound macaroons in binary format")
+	case formatText:
+		return nil, errgo.Newf("cannot format macaroons in text format")
 	default:
 		panic(errgo.Newf("unknown format %d", f))
 	}
@@ -250,6 +324,8 @@ func (f formatFlag) marshalBound(ms macaroon.Slice) ([]byte, error) {
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
+	case formatText:
+		return nil, errgo.Newf("cannot format macaroons in text format")
 	default:
 		panic(errgo.Newf("unknown format %d", f))
 	}
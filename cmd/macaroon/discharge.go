@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/juju/cmd"
 	"github.com/juju/gnuflag"
@@ -9,10 +13,25 @@ import (
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery/agent"
+)
+
+// Environment variables used by the discharge command.
+const (
+	// envAgentFile holds the path to the default agent file.
+	envAgentFile = "BAKERY_AGENT_FILE"
+
+	// envCookieFile holds the path to the default cookie file.
+	envCookieFile = "MACAROON_COOKIE_FILE"
 )
 
 type dischargeCommand struct {
-	macaroons bakery.Slice
+	macaroons   bakery.Slice
+	agentFile   string
+	interactors interactorsFlag
+	interactCmd string
+	cookieFile  string
+	cacheFile   string
 }
 
 func init() {
@@ -24,16 +43,74 @@ func (c *dischargeCommand) Info() *cmd.Info {
 		Name:    "discharge",
 		Args:    "macaroons",
 		Purpose: "Discharge all third party caveats and print resulting macaroons",
-		Doc:     `doc TODO`,
+		Doc: `
+The discharge command acquires discharges for all the third party
+caveats in the given macaroons, including any third party caveats
+in the discharges themselves, and prints the resulting macaroons
+in unbound JSON format (see the use command).
+
+If the --agent-file flag is given, or the BAKERY_AGENT_FILE
+environment variable is set, agent authentication is used
+with the third parties named in the agent file, so that no
+interaction is needed with them. The file holds a key pair
+and the URLs and usernames of the agents; it can be created
+with "macaroon newkey --agent".
+
+When a third party requires interaction and agent authentication
+can't be used, the --interactor flag selects the interaction
+methods to try, in priority order. It holds a comma-separated
+list of:
+
+	browser  - open the visit URL in a web browser (the default)
+	form     - prompt for the form fields on the terminal
+	command  - run the shell command given by --interact-cmd
+	           with the visit URL as its first argument ($1)
+	           and wait for it to complete
+
+For example:
+
+	macaroon discharge --interactor command --interact-cmd 'xdg-open "$1"' $m
+
+Cookies from the third parties, such as login cookies, are kept
+in the file given by --cookie-file, which defaults to the
+MACAROON_COOKIE_FILE environment variable or, if that is not
+set, the standard Go cookie file. They are saved even if the
+discharge fails.
+
+Discharge macaroons that have an expiry time are cached in the
+file given by --discharge-cache (by default discharges.json in
+the macaroon directory of the user's cache directory), and
+reused while they remain valid for at least another minute,
+so that repeated discharges of the same caveats don't contact
+the third parties again. Set --discharge-cache to the empty
+string to disable the cache.
+
+Other commands that need to discharge third party caveats
+in the access token use the same cookie file, discharge
+cache and agent file environment variable, but always
+use the browser interactor.
+`,
 	}
 }
 
-func (c *dischargeCommand) SetFlags(f *gnuflag.FlagSet) {}
+func (c *dischargeCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.agentFile, "agent-file", os.Getenv(envAgentFile), "file holding agent authentication information (defaults to $"+envAgentFile+")")
+	c.interactors = interactorsFlag{interactorBrowser}
+	f.Var(&c.interactors, "interactor", "comma-separated interaction methods to use in priority order (browser, form or command)")
+	f.StringVar(&c.interactCmd, "interact-cmd", "", "shell command to run with the visit URL as $1 when using the command interactor")
+	f.StringVar(&c.cookieFile, "cookie-file", defaultCookieFile(), "file to store cookies in (defaults to $"+envCookieFile+")")
+	f.StringVar(&c.cacheFile, "discharge-cache", defaultDischargeCacheFile(), "file to cache discharge macaroons in (empty to disable caching)")
+}
 
 func (c *dischargeCommand) Init(args []string) error {
 	if len(args) != 1 {
 		return errgo.New("need macaroon argument")
 	}
+	for _, name := range c.interactors {
+		if name == interactorCommand && c.interactCmd == "" {
+			return errgo.Newf("--interact-cmd must be specified with the %s interactor", interactorCommand)
+		}
+	}
 	ms, err := parseUnboundMacaroons(args[0])
 	if err != nil {
 		return errgo.Mask(err)
@@ -44,18 +121,49 @@ func (c *dischargeCommand) Init(args []string) error {
 
 func (c *dischargeCommand) Run(cmdCtx *cmd.Context) error {
 	ctx := context.Background()
-	jar, err := cookiejar.New(nil)
+	jar, err := cookiejar.New(&cookiejar.Options{
+		Filename: cmdCtx.AbsPath(c.cookieFile),
+	})
 	if err != nil {
 		return errgo.Notef(err, "cannot make cookiejar")
 	}
 	client := httpbakery.NewClient()
 	client.Client.Jar = jar
-	client.AddInteractor(httpbakery.WebBrowserInteractor{})
-	// TODO use local agent key when available.
-	ms, err := client.DischargeAllUnbound(ctx, c.macaroons)
+	if c.agentFile != "" {
+		if err := setUpAgent(client, cmdCtx.AbsPath(c.agentFile)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	for _, name := range c.interactors {
+		interactor, err := newInteractor(cmdCtx, name, c.interactCmd)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		client.AddInteractor(interactor)
+	}
+	getDischarge := client.AcquireDischarge
+	var cache *dischargeCache
+	if c.cacheFile != "" {
+		cache, err = loadDischargeCache(cmdCtx.AbsPath(c.cacheFile))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		getDischarge = cache.acquirer(getDischarge)
+	}
+	ms, err := c.macaroons.DischargeAll(ctx, getDischarge, client.Key)
+	// Save any cookies even if the discharge failed, so
+	// that login cookies can be used next time.
+	if err := jar.Save(); err != nil {
+		return errgo.Notef(err, "cannot save cookies")
+	}
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if cache != nil {
+		if err := cache.save(); err != nil {
+			return errgo.Notef(err, "cannot save discharge cache")
+		}
+	}
 	data, err := formatJSON.marshalUnbound(ms)
 	if err != nil {
 		return errgo.Mask(err)
@@ -71,3 +179,55 @@ func (c *dischargeCommand) IsSuperCommand() bool {
 func (c *dischargeCommand) AllowInterspersedFlags() bool {
 	return false
 }
+
+// setUpAgent sets up agent authentication on the given
+// client using the agent file at the given path.
+func setUpAgent(client *httpbakery.Client, path string) error {
+	authInfo, err := readAgentFile(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := agent.SetUpAuth(client, authInfo); err != nil {
+		return errgo.Notef(err, "cannot set up agent authentication")
+	}
+	return nil
+}
+
+// readAgentFile reads agent authentication information from the
+// given file. The file holds a JSON object with a "key" field holding
+// a key pair in the format printed by the newkey command, and an
+// "agents" field holding a list of objects with "url" and "username"
+// fields. It can be generated with "macaroon newkey --agent".
+func readAgentFile(path string) (*agent.AuthInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent file")
+	}
+	var authInfo agent.AuthInfo
+	if err := json.Unmarshal(data, &authInfo); err != nil {
+		return nil, errgo.Notef(err, "cannot parse agent file %q", path)
+	}
+	if authInfo.Key == nil {
+		return nil, errgo.Newf("no key found in agent file %q", path)
+	}
+	return &authInfo, nil
+}
+
+// defaultCookieFile returns the default location
+// of the cookie file.
+func defaultCookieFile() string {
+	if f := os.Getenv(envCookieFile); f != "" {
+		return f
+	}
+	return cookiejar.DefaultCookieFile()
+}
+
+// defaultDischargeCacheFile returns the default location
+// of the discharge cache.
+func defaultDischargeCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "macaroon", "discharges.json")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/persistent-cookiejar"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+)
+
+// dischargeExpiryMargin holds the minimum length of time that
+// a cached discharge macaroon must remain valid for it to be used.
+const dischargeExpiryMargin = time.Minute
+
+// dischargeCache holds discharge macaroons that have been
+// acquired previously, keyed by caveat id, so that they can
+// be reused without contacting the third party again.
+// Only discharge macaroons with an expiry time are cached.
+type dischargeCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*cachedDischarge
+	changed bool
+}
+
+// cachedDischarge holds the on-disk representation of
+// a cached discharge macaroon.
+type cachedDischarge struct {
+	Expires  time.Time        `json:"expires"`
+	Macaroon *bakery.Macaroon `json:"macaroon"`
+}
+
+// loadDischargeCache loads the discharge cache from the given file.
+// It is not an error if the file does not exist.
+func loadDischargeCache(path string) (*dischargeCache, error) {
+	c := &dischargeCache{
+		path:    path,
+		entries: make(map[string]*cachedDischarge),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, errgo.Notef(err, "cannot read discharge cache")
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, errgo.Notef(err, "invalid discharge cache %q", path)
+	}
+	now := time.Now()
+	for id, e := range c.entries {
+		if e.Macaroon == nil || !now.Before(e.Expires) {
+			delete(c.entries, id)
+			c.changed = true
+		}
+	}
+	return c, nil
+}
+
+// acquirer returns a function suitable for passing to bakery.Slice.DischargeAll
+// that uses cached discharges when possible and calls getDischarge
+// otherwise, adding the result to the cache.
+func (c *dischargeCache) acquirer(getDischarge func(context.Context, macaroon.Caveat, []byte) (*bakery.Macaroon, error)) func(context.Context, macaroon.Caveat, []byte) (*bakery.Macaroon, error) {
+	return func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+		key := base64.RawURLEncoding.EncodeToString(cav.Id)
+		c.mu.Lock()
+		e := c.entries[key]
+		c.mu.Unlock()
+		if e != nil && time.Now().Add(dischargeExpiryMargin).Before(e.Expires) {
+			return e.Macaroon.Clone(), nil
+		}
+		m, err := getDischarge(ctx, cav, payload)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		expires, ok := checkers.ExpiryTime(checkers.New(nil).Namespace(), m.M().Caveats())
+		if !ok {
+			return m, nil
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.entries[key] = &cachedDischarge{
+			Expires:  expires,
+			Macaroon: m.Clone(),
+		}
+		c.changed = true
+		return m, nil
+	}
+}
+
+// save writes the cache back to its file if it has changed.
+func (c *dischargeCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-discharges")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(f.Name(), c.path); err != nil {
+		return errgo.Mask(err)
+	}
+	c.changed = false
+	return nil
+}
+
+// cachingDischarger implements macaroondclient.Discharger by
+// acquiring discharges with an httpbakery client, persisting cookies
+// and caching the discharge macaroons in the same places as the
+// discharge command does by default.
+type cachingDischarger struct {
+	client *httpbakery.Client
+	jar    *cookiejar.Jar
+	cache  *dischargeCache
+}
+
+// newCachingDischarger returns a new cachingDischarger.
+// The agent file in $BAKERY_AGENT_FILE is used for
+// agent authentication if set; otherwise a web browser
+// is opened when interaction is required.
+func newCachingDischarger(cmdCtx *cmd.Context) (*cachingDischarger, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		Filename: cmdCtx.AbsPath(defaultCookieFile()),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make cookiejar")
+	}
+	client := httpbakery.NewClient()
+	client.Client.Jar = jar
+	if agentFile := os.Getenv(envAgentFile); agentFile != "" {
+		if err := setUpAgent(client, cmdCtx.AbsPath(agentFile)); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	client.AddInteractor(httpbakery.WebBrowserInteractor{})
+	d := &cachingDischarger{
+		client: client,
+		jar:    jar,
+	}
+	if cacheFile := defaultDischargeCacheFile(); cacheFile != "" {
+		d.cache, err = loadDischargeCache(cacheFile)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return d, nil
+}
+
+// AcquireDischarge implements macaroondclient.Discharger.AcquireDischarge.
+func (d *cachingDischarger) AcquireDischarge(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+	getDischarge := d.client.AcquireDischarge
+	if d.cache != nil {
+		getDischarge = d.cache.acquirer(getDischarge)
+	}
+	m, err := getDischarge(ctx, cav, payload)
+	if err := d.jar.Save(); err != nil {
+		return nil, errgo.Notef(err, "cannot save cookies")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if d.cache != nil {
+		if err := d.cache.save(); err != nil {
+			return nil, errgo.Notef(err, "cannot save discharge cache")
+		}
+	}
+	return m, nil
+}
+
+// lazyDischarger implements macaroondclient.Discharger by
+// creating a cachingDischarger when a discharge is first
+// required, so that commands using access tokens without
+// third party caveats don't depend on the cookie and
+// discharge cache files.
+type lazyDischarger struct {
+	cmdCtx *cmd.Context
+
+	once sync.Once
+	d    *cachingDischarger
+	err  error
+}
+
+// AcquireDischarge implements macaroondclient.Discharger.AcquireDischarge.
+func (d *lazyDischarger) AcquireDischarge(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+	d.once.Do(func() {
+		d.d, d.err = newCachingDischarger(d.cmdCtx)
+	})
+	if d.err != nil {
+		return nil, errgo.Mask(d.err)
+	}
+	return d.d.AcquireDischarge(ctx, cav, payload)
+}
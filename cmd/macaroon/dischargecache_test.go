@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+)
+
+func TestDischargeCache(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroon-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "discharges.json")
+
+	// A missing cache file is not an error.
+	cache, err := loadDischargeCache(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache.entries, qt.HasLen, 0)
+
+	expiry := time.Now().Add(time.Hour)
+	calls := 0
+	getDischarge := func(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error) {
+		calls++
+		m := newDischargeMacaroon(c, string(cav.Id))
+		if string(cav.Id) != "no-expiry" {
+			err := m.AddCaveat(ctx, checkers.TimeBeforeCaveat(expiry), nil, nil)
+			c.Assert(err, qt.Equals, nil)
+		}
+		return m, nil
+	}
+	acquire := cache.acquirer(getDischarge)
+
+	// The second discharge of a caveat comes from the cache.
+	m, err := acquire(context.Background(), macaroon.Caveat{Id: []byte("cav1")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(m.M().Id()), qt.Equals, "cav1")
+	m, err = acquire(context.Background(), macaroon.Caveat{Id: []byte("cav1")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(m.M().Id()), qt.Equals, "cav1")
+	c.Assert(calls, qt.Equals, 1)
+
+	// Discharges without an expiry time are not cached.
+	_, err = acquire(context.Background(), macaroon.Caveat{Id: []byte("no-expiry")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	_, err = acquire(context.Background(), macaroon.Caveat{Id: []byte("no-expiry")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 3)
+
+	// Errors are passed through and not cached.
+	_, err = cache.acquirer(func(context.Context, macaroon.Caveat, []byte) (*bakery.Macaroon, error) {
+		return nil, errgo.New("discharge failed")
+	})(context.Background(), macaroon.Caveat{Id: []byte("cav2")}, nil)
+	c.Assert(err, qt.ErrorMatches, `discharge failed`)
+	c.Assert(cache.entries, qt.HasLen, 1)
+
+	// The cache can be saved and loaded again.
+	err = cache.save()
+	c.Assert(err, qt.Equals, nil)
+	cache, err = loadDischargeCache(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache.entries, qt.HasLen, 1)
+	m, err = cache.acquirer(getDischarge)(context.Background(), macaroon.Caveat{Id: []byte("cav1")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(m.M().Id()), qt.Equals, "cav1")
+	c.Assert(calls, qt.Equals, 3)
+
+	// A discharge that is about to expire is acquired again.
+	expiry = time.Now().Add(dischargeExpiryMargin / 2)
+	_, err = cache.acquirer(getDischarge)(context.Background(), macaroon.Caveat{Id: []byte("cav3")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	_, err = cache.acquirer(getDischarge)(context.Background(), macaroon.Caveat{Id: []byte("cav3")}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 5)
+}
+
+func TestLoadDischargeCacheDropsExpiredEntries(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroon-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "discharges.json")
+
+	cache, err := loadDischargeCache(path)
+	c.Assert(err, qt.Equals, nil)
+	cache.entries["expired"] = &cachedDischarge{
+		Expires:  time.Now().Add(-time.Minute),
+		Macaroon: newDischargeMacaroon(c, "expired"),
+	}
+	cache.entries["valid"] = &cachedDischarge{
+		Expires:  time.Now().Add(time.Hour),
+		Macaroon: newDischargeMacaroon(c, "valid"),
+	}
+	cache.changed = true
+	err = cache.save()
+	c.Assert(err, qt.Equals, nil)
+
+	cache, err = loadDischargeCache(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cache.entries, qt.HasLen, 1)
+	c.Assert(cache.entries["valid"], qt.Not(qt.IsNil))
+	c.Assert(cache.changed, qt.Equals, true)
+
+	err = ioutil.WriteFile(path, []byte("{"), 0600)
+	c.Assert(err, qt.Equals, nil)
+	_, err = loadDischargeCache(path)
+	c.Assert(err, qt.ErrorMatches, `invalid discharge cache ".*": .*`)
+}
+
+func newDischargeMacaroon(c *qt.C, id string) *bakery.Macaroon {
+	m, err := bakery.NewMacaroon([]byte("root key"), []byte(id), "", bakery.LatestVersion, checkers.New(nil).Namespace())
+	c.Assert(err, qt.Equals, nil)
+	return m
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+// macaroonsTokenKind holds the kind of discharge token
+// that holds macaroons. The value of such a token is
+// a JSON-encoded array of bound macaroon slices.
+const macaroonsTokenKind = "macaroons"
+
+type dischargerCommand struct {
+	addr     string
+	keyFile  string
+	specFile string
+}
+
+func init() {
+	register(&dischargerCommand{})
+}
+
+func (c *dischargerCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "discharger",
+		Args:    "json-spec",
+		Purpose: "Run a third party caveat discharge service",
+		Doc: `
+The discharger command runs a third party caveat discharge
+service. The json-spec file maps caveat conditions to the
+operations that are required to discharge them. It holds
+a JSON array of rules, for example:
+
+	[{
+		"condition": "answered-quiz ([a-z]+)",
+		"ops": ["answered:\\1"]
+	}]
+
+A caveat condition can be discharged if it matches the
+condition regular expression of a rule (the whole condition must
+match) and the discharge token provided by the client holds
+macaroons that allow all the rule's operations. Back-references
+of the form \N in the operations are replaced by the
+text matched by the Nth parenthesized subexpression. Note
+that the backslash must be escaped in JSON, as in the example.
+
+The macaroons may be provided as a discharge token of kind
+"macaroons" or attached to the discharge request in the
+usual way. They are checked as by the check command, so
+MACAROON_ACCESS_TOKEN must be set.
+`,
+	}
+}
+
+func (c *dischargerCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.addr, "addr", "localhost:8080", "address to listen on")
+	f.StringVar(&c.keyFile, "key", "", "file holding the discharger's key pair in JSON format (a new key is generated if empty)")
+}
+
+func (c *dischargerCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errgo.Newf("need json-spec argument")
+	}
+	c.specFile = args[0]
+	return nil
+}
+
+func (c *dischargerCommand) Run(cmdCtx *cmd.Context) error {
+	rules, err := readDischargeRules(cmdCtx.AbsPath(c.specFile))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := c.key(cmdCtx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// The discharger serves requests without a terminal, so
+	// it must not prompt for the password when the macaroond
+	// server is locked.
+	oven, err := newOven(cmdCtx, nil, false)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
+		Key:     key,
+		Locator: httpbakery.NewThirdPartyLocator(nil, nil),
+		Checker: &dischargeChecker{
+			rules: rules,
+			oven:  oven,
+		},
+	})
+	mux := http.NewServeMux()
+	d.AddMuxHandlers(mux, "/")
+	listener, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		return errgo.Notef(err, "cannot listen")
+	}
+	fmt.Fprintf(cmdCtx.Stderr, "discharger listening on %s with public key %s\n", listener.Addr(), key.Public.String())
+	return http.Serve(listener, mux)
+}
+
+// key returns the key pair to use for the discharger.
+func (c *dischargerCommand) key(cmdCtx *cmd.Context) (*bakery.KeyPair, error) {
+	if c.keyFile == "" {
+		return bakery.GenerateKey()
+	}
+	data, err := ioutil.ReadFile(cmdCtx.AbsPath(c.keyFile))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var key bakery.KeyPair
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errgo.Notef(err, "invalid key file %q", c.keyFile)
+	}
+	return &key, nil
+}
+
+func (c *dischargerCommand) IsSuperCommand() bool {
+	return false
+}
+
+func (c *dischargerCommand) AllowInterspersedFlags() bool {
+	return false
+}
+
+// dischargeRule holds a rule from the discharger's JSON spec.
+type dischargeRule struct {
+	// Condition holds a regular expression that
+	// matches the caveat conditions that the
+	// rule applies to.
+	Condition string `json:"condition"`
+
+	// Ops holds the operations that must be allowed
+	// for a caveat to be discharged. They may contain
+	// back-references to subexpressions of Condition.
+	Ops []string `json:"ops"`
+
+	re *regexp.Regexp
+}
+
+// backrefPattern matches a back-reference in a rule operation.
+var backrefPattern = regexp.MustCompile(`\\([0-9])`)
+
+// readDischargeRules reads the discharge rules from the given file.
+func readDischargeRules(path string) ([]*dischargeRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var rules []*dischargeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
+	for i, r := range rules {
+		re, err := regexp.Compile("^(?:" + r.Condition + ")$")
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid condition in rule %d", i)
+		}
+		if len(r.Ops) == 0 {
+			return nil, errgo.Newf("no operations in rule %d", i)
+		}
+		r.re = re
+	}
+	return rules, nil
+}
+
+// ops returns the operations required to discharge the given
+// condition, and reports whether the rule matches the condition.
+func (r *dischargeRule) ops(cond string) ([]bakery.Op, bool, error) {
+	match := r.re.FindStringSubmatchIndex(cond)
+	if match == nil {
+		return nil, false, nil
+	}
+	ops := make([]bakery.Op, len(r.Ops))
+	for i, op := range r.Ops {
+		// Escape any $ characters so that only our
+		// back-references are expanded.
+		template := strings.Replace(op, "$", "$$", -1)
+		template = backrefPattern.ReplaceAllString(template, "$${$1}")
+		expanded := string(r.re.ExpandString(nil, template, cond, match))
+		parsedOp, err := parseOp(expanded)
+		if err != nil {
+			return nil, false, errgo.Notef(err, "bad operation in rule")
+		}
+		ops[i] = parsedOp
+	}
+	return ops, true, nil
+}
+
+// dischargeChecker implements httpbakery.ThirdPartyCaveatChecker
+// by checking caveat conditions against a set of discharge rules.
+type dischargeChecker struct {
+	rules []*dischargeRule
+	oven  oven
+}
+
+// CheckThirdPartyCaveat implements httpbakery.ThirdPartyCaveatChecker.CheckThirdPartyCaveat.
+func (c *dischargeChecker) CheckThirdPartyCaveat(ctx context.Context, info *bakery.ThirdPartyCaveatInfo, req *http.Request, token *httpbakery.DischargeToken) ([]checkers.Caveat, error) {
+	cond := string(info.Condition)
+	var ops []bakery.Op
+	for _, r := range c.rules {
+		rops, ok, err := r.ops(cond)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if ok {
+			ops = rops
+			break
+		}
+	}
+	if ops == nil {
+		return nil, checkers.ErrCaveatNotRecognized
+	}
+	mss := httpbakery.RequestMacaroons(req)
+	if token != nil && token.Kind == macaroonsTokenKind {
+		var tokenMacaroons []macaroon.Slice
+		if err := json.Unmarshal(token.Value, &tokenMacaroons); err != nil {
+			return nil, errgo.WithCausef(err, httpbakery.ErrBadRequest, "invalid discharge token")
+		}
+		mss = append(mss, tokenMacaroons...)
+	}
+	checkCtx := params.CheckContext{
+		Origin: req.Header.Get("Origin"),
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		checkCtx.ClientIPAddr = host
+	}
+	resp, err := c.oven.CheckMacaroons(ctx, mss, ops, checkCtx, nil)
+	switch errgo.Cause(err) {
+	case nil:
+	case params.ErrVerificationFailed:
+		return nil, errgo.WithCausef(err, httpbakery.ErrPermissionDenied, "")
+	case params.ErrLocked:
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	default:
+		return nil, errgo.Notef(err, "cannot check discharge token")
+	}
+	if len(resp.UnknownConditions) > 0 {
+		return nil, errgo.WithCausef(nil, httpbakery.ErrPermissionDenied, "discharge token has unrecognized caveat %q", resp.UnknownConditions[0])
+	}
+	return nil, nil
+}
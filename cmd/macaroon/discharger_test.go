@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
+)
+
+var readDischargeRulesTests = []struct {
+	about       string
+	spec        string
+	expectError string
+}{{
+	about: "valid rules",
+	spec: `[{
+		"condition": "answered-quiz ([a-z]+)",
+		"ops": ["answered:\\1"]
+	}, {
+		"condition": "is-admin",
+		"ops": ["admin:global", "read:global"]
+	}]`,
+}, {
+	about:       "invalid JSON",
+	spec:        `[{"condition": "x", "ops": ["answered:\1"]}]`,
+	expectError: `cannot parse ".*": invalid .*`,
+}, {
+	about:       "invalid condition",
+	spec:        `[{"condition": "x", "ops": ["a:b"]}, {"condition": "(", "ops": ["a:b"]}]`,
+	expectError: `invalid condition in rule 1: error parsing regexp: .*`,
+}, {
+	about:       "no operations",
+	spec:        `[{"condition": "x"}]`,
+	expectError: `no operations in rule 0`,
+}}
+
+func TestReadDischargeRules(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroon-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spec.json")
+	for _, test := range readDischargeRulesTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := ioutil.WriteFile(path, []byte(test.spec), 0666)
+			c.Assert(err, qt.Equals, nil)
+			rules, err := readDischargeRules(path)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(rules, qt.HasLen, 2)
+			c.Assert(rules[0].Ops, qt.DeepEquals, []string{`answered:\1`})
+		})
+	}
+}
+
+var dischargeRuleOpsTests = []struct {
+	about     string
+	condition string
+	ops       []string
+	cond      string
+	expectOps []bakery.Op
+	expectOK  bool
+	expectErr string
+}{{
+	about:     "back-references",
+	condition: `answered-quiz ([a-z]+) ([0-9]+)`,
+	ops:       []string{`answered:\1-\2`, `read:\2`},
+	cond:      "answered-quiz maths 42",
+	expectOps: []bakery.Op{{
+		Action: "answered",
+		Entity: "maths-42",
+	}, {
+		Action: "read",
+		Entity: "42",
+	}},
+	expectOK: true,
+}, {
+	about:     "dollar signs are not expanded",
+	condition: `pay ([a-z]+)`,
+	ops:       []string{`pay:$1-\1-${1}`},
+	cond:      "pay bob",
+	expectOps: []bakery.Op{{
+		Action: "pay",
+		Entity: "$1-bob-${1}",
+	}},
+	expectOK: true,
+}, {
+	about:     "no match",
+	condition: `answered-quiz ([a-z]+)`,
+	ops:       []string{`answered:\1`},
+	cond:      "something else",
+}, {
+	about:     "the whole condition must match",
+	condition: `answered-quiz ([a-z]+)`,
+	ops:       []string{`answered:\1`},
+	cond:      "answered-quiz maths and more",
+}, {
+	about:     "expanded operation is invalid",
+	condition: `answered-quiz ([a-z]*)`,
+	ops:       []string{`answered:\1`},
+	cond:      "answered-quiz ",
+	expectErr: `bad operation in rule: .*`,
+}}
+
+func TestDischargeRuleOps(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroon-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spec.json")
+	for _, test := range dischargeRuleOpsTests {
+		c.Run(test.about, func(c *qt.C) {
+			data, err := json.Marshal([]dischargeRule{{
+				Condition: test.condition,
+				Ops:       test.ops,
+			}})
+			c.Assert(err, qt.Equals, nil)
+			err = ioutil.WriteFile(path, data, 0666)
+			c.Assert(err, qt.Equals, nil)
+			rules, err := readDischargeRules(path)
+			c.Assert(err, qt.Equals, nil)
+			ops, ok, err := rules[0].ops(test.cond)
+			if test.expectErr != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectErr)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(ok, qt.Equals, test.expectOK)
+			c.Assert(ops, qt.DeepEquals, test.expectOps)
+		})
+	}
+}
+
+var dischargeCheckerErrorTests = []struct {
+	about        string
+	err          error
+	expectError  string
+	expectStatus int
+}{{
+	about:        "operations not allowed",
+	err:          errgo.WithCausef(nil, params.ErrVerificationFailed, "permission denied"),
+	expectError:  `permission denied`,
+	expectStatus: http.StatusUnauthorized,
+}, {
+	about:        "server locked",
+	err:          errgo.WithCausef(nil, params.ErrLocked, "server is locked"),
+	expectError:  `server is locked`,
+	expectStatus: http.StatusInternalServerError,
+}, {
+	about:        "other error",
+	err:          errgo.New("connection refused"),
+	expectError:  `cannot check discharge token: connection refused`,
+	expectStatus: http.StatusInternalServerError,
+}}
+
+func TestDischargeCheckerErrors(t *testing.T) {
+	c := qt.New(t)
+	rules := []*dischargeRule{{
+		Ops: []string{"read:x"},
+		re:  regexp.MustCompile(`^is-ok$`),
+	}}
+	for _, test := range dischargeCheckerErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			checker := &dischargeChecker{
+				rules: rules,
+				oven:  errorOven{test.err},
+			}
+			_, err := checker.CheckThirdPartyCaveat(context.Background(), &bakery.ThirdPartyCaveatInfo{
+				Condition: []byte("is-ok"),
+			}, httptest.NewRequest("POST", "/discharge", nil), nil)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			status, _ := httpbakery.ErrorToResponse(context.Background(), err)
+			c.Assert(status, qt.Equals, test.expectStatus)
+		})
+	}
+}
+
+// errorOven implements oven by returning an error
+// from all its methods.
+type errorOven struct {
+	err error
+}
+
+func (o errorOven) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, ops ...bakery.Op) (*bakery.Macaroon, error) {
+	return nil, o.err
+}
+
+func (o errorOven) CheckMacaroons(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) (*params.CheckMacaroonResponse, error) {
+	return nil, o.err
+}
+
+func (o errorOven) CheckOps(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) ([]params.OpStatus, error) {
+	return nil, o.err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/juju/environschema.v1/form"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	httpbakeryform "gopkg.in/macaroon-bakery.v2-unstable/httpbakery/form"
+)
+
+// Names of the interactors that can be selected
+// with the --interactor flag.
+const (
+	interactorBrowser = "browser"
+	interactorForm    = "form"
+	interactorCommand = "command"
+)
+
+// interactorsFlag implements gnuflag.Value by holding
+// a comma-separated list of interactor names.
+type interactorsFlag []string
+
+func (f *interactorsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *interactorsFlag) Set(s string) error {
+	names := strings.Split(s, ",")
+	for _, name := range names {
+		switch name {
+		case interactorBrowser, interactorForm, interactorCommand:
+		default:
+			return errgo.Newf("unknown interactor %q (must be one of %s, %s or %s)", name, interactorBrowser, interactorForm, interactorCommand)
+		}
+	}
+	*f = names
+	return nil
+}
+
+// newInteractor returns the interactor with the given name.
+// The interactCmd argument holds the command used by
+// the command interactor.
+func newInteractor(cmdCtx *cmd.Context, name string, interactCmd string) (httpbakery.Interactor, error) {
+	switch name {
+	case interactorBrowser:
+		return httpbakery.WebBrowserInteractor{}, nil
+	case interactorForm:
+		return httpbakeryform.Interactor{
+			Filler: consoleFiller{cmdCtx},
+		}, nil
+	case interactorCommand:
+		if strings.TrimSpace(interactCmd) == "" {
+			return nil, errgo.Newf("--interact-cmd must be specified with the %s interactor", interactorCommand)
+		}
+		return httpbakery.WebBrowserInteractor{
+			OpenWebBrowser: func(u *url.URL) error {
+				return runInteractCmd(cmdCtx, interactCmd, u)
+			},
+		}, nil
+	}
+	return nil, errgo.Newf("unknown interactor %q", name)
+}
+
+// runInteractCmd runs the given shell command and waits for it
+// to complete. The visit URL is passed as the first positional
+// parameter ($1), so the command doesn't need to quote it.
+func runInteractCmd(cmdCtx *cmd.Context, interactCmd string, u *url.URL) error {
+	c := exec.Command("sh", "-c", interactCmd, "sh", u.String())
+	c.Dir = cmdCtx.Dir
+	c.Stdin = cmdCtx.Stdin
+	c.Stdout = cmdCtx.Stderr
+	c.Stderr = cmdCtx.Stderr
+	if err := c.Run(); err != nil {
+		return errgo.Notef(err, "interaction command failed")
+	}
+	return nil
+}
+
+// consoleFiller implements form.Filler by prompting for
+// each field on the terminal. Secret fields are read
+// without echoing them.
+type consoleFiller struct {
+	cmdCtx *cmd.Context
+}
+
+// Fill implements form.Filler.Fill.
+func (f consoleFiller) Fill(fm form.Form) (map[string]interface{}, error) {
+	if fm.Title != "" {
+		fmt.Fprintf(f.cmdCtx.Stderr, "%s\n", fm.Title)
+	}
+	names := make([]string, 0, len(fm.Fields))
+	for name := range fm.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string]interface{})
+	for _, name := range names {
+		attr := fm.Fields[name]
+		prompt := attr.Description
+		if prompt == "" {
+			prompt = name
+		}
+		prompt += ": "
+		var s string
+		var err error
+		if attr.Secret {
+			s, err = readPassword(f.cmdCtx, prompt)
+		} else {
+			fmt.Fprintf(f.cmdCtx.Stderr, "%s", prompt)
+			s, err = readLine(f.cmdCtx.Stdin)
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if s == "" && !attr.Mandatory {
+			continue
+		}
+		checker, err := attr.Checker()
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid field %q", name)
+		}
+		v, err := checker.Coerce(s, nil)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid value for %q", name)
+		}
+		values[name] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/cmd"
+)
+
+func TestRunInteractCmd(t *testing.T) {
+	c := qt.New(t)
+	var stderr bytes.Buffer
+	cmdCtx := &cmd.Context{
+		Dir:    c.Mkdir(),
+		Stdin:  strings.NewReader(""),
+		Stdout: &stderr,
+		Stderr: &stderr,
+	}
+	u, err := url.Parse("https://example.com/visit?a=1&b=$HOME;x")
+	c.Assert(err, qt.Equals, nil)
+
+	// The command is run by the shell, and the URL is
+	// passed to it as $1 without any interpretation.
+	err = runInteractCmd(cmdCtx, `echo "visit: $1" | tr a-z A-Z`, u)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(stderr.String(), qt.Equals, "VISIT: HTTPS://EXAMPLE.COM/VISIT?A=1&B=$HOME;X\n")
+
+	err = runInteractCmd(cmdCtx, "exit 1", u)
+	c.Assert(err, qt.ErrorMatches, `interaction command failed: exit status 1`)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/juju/cmd"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+// keyStore is implemented by the types that hold the key
+// pair used when adding third party caveats.
+type keyStore interface {
+	// KeyPair returns the stored key pair, creating
+	// a new one if none has been stored yet.
+	KeyPair(ctx context.Context) (*bakery.KeyPair, error)
+
+	// SetKeyPair replaces the stored key pair.
+	SetKeyPair(ctx context.Context, key *bakery.KeyPair) error
+}
+
+var (
+	_ keyStore = (*fileKeyStore)(nil)
+	_ keyStore = (*daemonOven)(nil)
+)
+
+// newKeyStore returns the key store associated with the
+// access token in the environment. For a local file token,
+// the key pair is stored next to the root key.
+func newKeyStore(cmdCtx *cmd.Context) (keyStore, error) {
+	tok := os.Getenv(envToken)
+	if tok == "" {
+		return nil, errNoAccessToken
+	}
+	if path := strings.TrimPrefix(tok, "localfile:"); len(path) != len(tok) {
+		return newFileKeyStore(keyPairPath(path)), nil
+	}
+	client, err := newDaemonClient(cmdCtx, tok)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &daemonOven{
+		client: client,
+		cmdCtx: cmdCtx,
+		prompt: true,
+	}, nil
+}
+
+// localKey returns the key pair from the key store associated
+// with the access token in the environment, or nil if there
+// is no access token.
+func localKey(cmdCtx *cmd.Context) (*bakery.KeyPair, error) {
+	ks, err := newKeyStore(cmdCtx)
+	if err == errNoAccessToken {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	key, err := ks.KeyPair(context.Background())
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// keyPairPath returns the path of the key pair file
+// that's kept alongside the given root key file.
+func keyPairPath(rootKeyPath string) string {
+	return rootKeyPath + ".key"
+}
+
+// KeyPair implements keyStore.KeyPair by getting
+// the key pair from the macaroond server.
+func (o *daemonOven) KeyPair(ctx context.Context) (*bakery.KeyPair, error) {
+	var key *bakery.KeyPair
+	err := o.withUnlock(ctx, func() error {
+		resp, err := o.client.GetKeyPair(ctx, &params.GetKeyPairRequest{})
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrLocked))
+		}
+		key = resp.KeyPair
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// SetKeyPair implements keyStore.SetKeyPair by storing
+// the key pair in the macaroond server.
+func (o *daemonOven) SetKeyPair(ctx context.Context, key *bakery.KeyPair) error {
+	err := o.withUnlock(ctx, func() error {
+		return o.client.SetKeyPair(ctx, &params.SetKeyPairRequest{
+			Body: params.SetKeyPairRequestBody{
+				KeyPair: key,
+			},
+		})
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// fileKeyStore implements keyStore by storing the
+// key pair in a local file in JSON format.
+//
+// TODO encrypt key at rest.
+type fileKeyStore struct {
+	path string
+
+	mu  sync.Mutex
+	key *bakery.KeyPair
+}
+
+func newFileKeyStore(path string) *fileKeyStore {
+	return &fileKeyStore{
+		path: path,
+	}
+}
+
+// KeyPair implements keyStore.KeyPair.
+func (s *fileKeyStore) KeyPair(context.Context) (*bakery.KeyPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != nil {
+		return s.key, nil
+	}
+	key, err := s.readKey()
+	if err == nil {
+		s.key = key
+		return key, nil
+	}
+	if !os.IsNotExist(errgo.Cause(err)) {
+		return nil, errgo.Mask(err)
+	}
+	key, err = bakery.GenerateKey()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tmpPath, err := s.writeTemp(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer os.Remove(tmpPath)
+	// Link the complete file into place so that the key file
+	// is never seen partially written, and so that we don't
+	// replace a key that someone else has created meanwhile.
+	if err := os.Link(tmpPath, s.path); err != nil {
+		if !os.IsExist(err) {
+			return nil, errgo.Mask(err)
+		}
+		// Someone else created the key at the same
+		// time, so use theirs.
+		key, err = s.readKey()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	s.key = key
+	return key, nil
+}
+
+// SetKeyPair implements keyStore.SetKeyPair.
+func (s *fileKeyStore) SetKeyPair(_ context.Context, key *bakery.KeyPair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmpPath, err := s.writeTemp(key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(tmpPath)
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errgo.Mask(err)
+	}
+	s.key = key
+	return nil
+}
+
+// writeTemp writes the given key to a temporary file in
+// the same directory as the key file and returns its path.
+// The file is synced to stable storage.
+func (s *fileKeyStore) writeTemp(key *bakery.KeyPair) (string, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".tmp-key")
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errgo.Mask(err)
+	}
+	return f.Name(), nil
+}
+
+func (s *fileKeyStore) readKey() (*bakery.KeyPair, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	var key bakery.KeyPair
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errgo.Notef(err, "invalid key pair in %q", s.path)
+	}
+	return &key, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+type lockCommand struct{}
+
+func init() {
+	register(&lockCommand{})
+}
+
+func (c *lockCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "lock",
+		Purpose: "Lock the macaroond server",
+		Doc: `
+The lock command causes the macaroond server to forget
+its decrypted root keys. The password will be prompted for
+the next time a root key is needed.
+`,
+	}
+}
+
+func (c *lockCommand) SetFlags(f *gnuflag.FlagSet) {}
+
+func (c *lockCommand) Init(args []string) error {
+	if len(args) != 0 {
+		return errgo.Newf("unexpected arguments")
+	}
+	return nil
+}
+
+func (c *lockCommand) Run(cmdCtx *cmd.Context) error {
+	tok := os.Getenv(envToken)
+	if tok == "" {
+		return errNoAccessToken
+	}
+	if strings.HasPrefix(tok, "localfile:") {
+		return errgo.Newf("cannot lock local file root key store")
+	}
+	client, err := newDaemonClient(cmdCtx, tok)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := client.Lock(context.Background(), &params.LockRequest{}); err != nil {
+		return errgo.Notef(err, "cannot lock server")
+	}
+	return nil
+}
+
+func (c *lockCommand) IsSuperCommand() bool {
+	return false
+}
+
+func (c *lockCommand) AllowInterspersedFlags() bool {
+	return false
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
@@ -18,8 +20,9 @@ import (
 )
 
 type loginCommand struct {
-	network string
-	addr    string
+	serverFlags
+	lifetime time.Duration
+	ops      string
 }
 
 func init() {
@@ -35,8 +38,9 @@ func (c *loginCommand) Info() *cmd.Info {
 }
 
 func (c *loginCommand) SetFlags(f *gnuflag.FlagSet) {
-	f.StringVar(&c.network, "t", params.DefaultNetwork, "network to use to connect to server (unix, tcp or file)")
-	f.StringVar(&c.addr, "addr", params.DefaultAddress, "address or socket path to connect to, or file path for local")
+	c.serverFlags.SetFlags(f)
+	f.DurationVar(&c.lifetime, "lifetime", 0, "lifetime of the access token (defaults to the maximum allowed by the server)")
+	f.StringVar(&c.ops, "ops", "", "comma-separated operations allowed by the access token (e.g. macaroon:check,key:new; defaults to all)")
 }
 
 func (c *loginCommand) Init(args []string) error {
@@ -46,15 +50,29 @@ func (c *loginCommand) Init(args []string) error {
 func (c *loginCommand) Run(cmdCtx *cmd.Context) error {
 	ctx := context.Background()
 	// TODO Check whether we're already logged in ?
-	client := macaroondclient.New(c.network, c.addr, nil)
-	// Try to log in with no password in case the initial password has
-	// not been set yet.
-	_, err := client.Login(ctx, "")
-	if err == nil {
-		return errgo.Newf("unexpected success logging in with empty password")
+	serverParams, err := c.absParams()
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	var m *bakery.Macaroon
-	if errgo.Cause(err) == params.ErrInitialPasswordNeeded {
+	client, err := macaroondclient.New(serverParams, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req := &params.AccessRequest{
+		// Round up so that a short lifetime is not
+		// mistaken for the server's maximum.
+		LifetimeSeconds: int64((c.lifetime + time.Second - 1) / time.Second),
+	}
+	if c.ops != "" {
+		req.Ops = strings.Split(c.ops, ",")
+	}
+	// Try to log in with no password in case the initial password has
+	// not been set yet or the server allows us in without one.
+	m, err := client.Login(ctx, req)
+	switch {
+	case err == nil:
+		// The server has authenticated us by our user id.
+	case errgo.Cause(err) == params.ErrInitialPasswordNeeded:
 		fmt.Fprintf(cmdCtx.Stdout, "Choose initial password for macaroon root keys\n")
 		pw1, err := readPassword(cmdCtx, "Password: ")
 		if err != nil {
@@ -72,21 +90,23 @@ func (c *loginCommand) Run(cmdCtx *cmd.Context) error {
 		}); err != nil {
 			return errgo.Notef(err, "cannot set password")
 		}
-		m, err = client.Login(ctx, pw1)
+		req.Password = pw1
+		m, err = client.Login(ctx, req)
 		if err != nil {
 			return errgo.Notef(err, "cannot log in with new password")
 		}
-	} else {
+	default:
 		pw, err := readPassword(cmdCtx, "Password: ")
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		m, err = client.Login(ctx, pw)
+		req.Password = pw
+		m, err = client.Login(ctx, req)
 		if err != nil {
 			return errgo.Notef(err, "cannot log in")
 		}
 	}
-	m.M().SetLocation(c.network + " " + c.addr)
+	m.M().SetLocation(serverParams.Location())
 	tok, err := formatJSON.marshalUnbound(bakery.Slice{m})
 	if err != nil {
 		return errgo.Mask(err)
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+)
+
+// macaroonIdInfo holds the information that can be
+// decoded from a macaroon id created by a bakery oven.
+type macaroonIdInfo struct {
+	// version holds the bakery version of the id.
+	version bakery.Version
+
+	// nonce holds the random nonce that makes the
+	// id unique, if any.
+	nonce []byte
+
+	// rootKeyId holds the id of the root key
+	// in the root key store.
+	rootKeyId []byte
+
+	// ops holds the operations associated with the
+	// macaroon. Ids earlier than Version3 don't hold
+	// any operations.
+	ops []bakery.Op
+}
+
+// decodeMacaroonId decodes the given macaroon id in the
+// same way that bakery.Oven does. It returns an error if the
+// id is not in a recognized format.
+func decodeMacaroonId(id []byte) (*macaroonIdInfo, error) {
+	if len(id) == 0 {
+		return nil, errgo.Newf("empty id")
+	}
+	if id[0] == 'A' {
+		// It's probably the base64 encoding of a Version2 or
+		// Version3 id (see bakery.Oven.decodeMacaroonId).
+		if dec, err := base64.RawURLEncoding.DecodeString(string(id)); err == nil && len(dec) > 0 {
+			id = dec
+		}
+	}
+	switch id[0] {
+	case byte(bakery.Version2):
+		if len(id) < 1+16 {
+			return nil, errgo.Newf("version 2 id too short")
+		}
+		return &macaroonIdInfo{
+			version:   bakery.Version2,
+			nonce:     id[1 : 1+16],
+			rootKeyId: id[1+16:],
+		}, nil
+	case byte(bakery.Version3):
+		info, err := unmarshalMacaroonIdProto(id[1:])
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal version 3 id")
+		}
+		info.version = bakery.Version3
+		return info, nil
+	}
+	if isLowerCaseHexChar(id[0]) {
+		// It's an old-style id with a hyphenated UUID.
+		if i := bytes.LastIndexByte(id, '-'); i >= 0 {
+			return &macaroonIdInfo{
+				version:   bakery.Version1,
+				rootKeyId: id[0:i],
+			}, nil
+		}
+	}
+	return nil, errgo.Newf("unrecognized id format")
+}
+
+// multiOpEntityPrefix holds the prefix of the entity that
+// bakery.Oven uses in place of multiple operations when
+// it stores them in its MultiOpStore. The rest of the
+// entity holds a hash of the operations.
+const multiOpEntityPrefix = "multi-"
+
+// opsStoreKey returns the key that the macaroon's
+// operations are stored under in the oven's MultiOpStore,
+// and reports whether there is one.
+func (info *macaroonIdInfo) opsStoreKey() (string, bool) {
+	if len(info.ops) != 1 || !strings.HasPrefix(info.ops[0].Entity, multiOpEntityPrefix) {
+		return "", false
+	}
+	return info.ops[0].Entity, true
+}
+
+func isLowerCaseHexChar(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+// unmarshalMacaroonIdProto decodes the protobuf encoding of a
+// Version3 macaroon id, as defined in bakery/internal/macaroonpb:
+//
+//	message MacaroonId {
+//		bytes nonce = 1;
+//		bytes storageId = 2;
+//		repeated Op ops = 3;
+//	}
+//
+//	message Op {
+//		string entity = 1;
+//		repeated string actions = 2;
+//	}
+func unmarshalMacaroonIdProto(data []byte) (*macaroonIdInfo, error) {
+	var info macaroonIdInfo
+	err := parseProtoFields(data, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			info.nonce = value
+		case 2:
+			info.rootKeyId = value
+		case 3:
+			var entity string
+			var actions []string
+			err := parseProtoFields(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					entity = string(value)
+				case 2:
+					actions = append(actions, string(value))
+				}
+				return nil
+			})
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			for _, action := range actions {
+				info.ops = append(info.ops, bakery.Op{
+					Entity: entity,
+					Action: action,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &info, nil
+}
+
+// parseProtoFields calls f for each length-delimited field in
+// the given protobuf-encoded message. Varint fields are skipped;
+// other wire types are an error.
+func parseProtoFields(data []byte, f func(field int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errgo.Newf("bad field key")
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0:
+			_, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errgo.Newf("bad varint in field %d", field)
+			}
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errgo.Newf("bad length in field %d", field)
+			}
+			data = data[n:]
+			if err := f(field, data[:size]); err != nil {
+				return errgo.Mask(err)
+			}
+			data = data[size:]
+		default:
+			return errgo.Newf("unexpected wire type %d in field %d", wireType, field)
+		}
+	}
+	return nil
+}
+
+// publicKeyPrefixLen holds the number of bytes of the
+// third party's public key that are held in a version 2
+// or version 3 caveat id.
+const publicKeyPrefixLen = 4
+
+// caveatIdInfo holds the information that can be decoded
+// from an encrypted third party caveat id without knowing
+// the third party's private key.
+type caveatIdInfo struct {
+	// version holds the bakery version of the caveat.
+	version bakery.Version
+
+	// thirdPartyPublicKey holds the public key of the third
+	// party that the caveat is encrypted for. Only the first
+	// publicKeyPrefixLen bytes are known for caveats later
+	// than Version1.
+	thirdPartyPublicKey []byte
+
+	// firstPartyPublicKey holds the public key of the
+	// party that added the caveat.
+	firstPartyPublicKey bakery.PublicKey
+
+	// nonce holds the nonce used to encrypt the caveat.
+	nonce [bakery.NonceLen]byte
+
+	// sealed holds the encrypted part of the caveat.
+	sealed []byte
+}
+
+// caveatIdJSON holds the format of a Version1
+// JSON-encoded third party caveat id.
+type caveatIdJSON struct {
+	ThirdPartyPublicKey *bakery.PublicKey
+	FirstPartyPublicKey *bakery.PublicKey
+	Nonce               []byte
+	Id                  string
+}
+
+// decodeCaveatId decodes the unencrypted part of the given third
+// party caveat id, which should be the caveat's payload when there
+// is one, in the same way that bakery.Discharge does. It returns an
+// error if the caveat id is not in a recognized format.
+//
+// The Version2 and Version3 formats hold the following fields:
+//
+//	version [1 byte]
+//	first 4 bytes of third party public key [4 bytes]
+//	first party public key [32 bytes]
+//	nonce [24 bytes]
+//	encrypted secret part [rest of id]
+func decodeCaveatId(id []byte) (*caveatIdInfo, error) {
+	if len(id) == 0 {
+		return nil, errgo.Newf("empty caveat id")
+	}
+	switch id[0] {
+	case byte(bakery.Version2), byte(bakery.Version3):
+		headerLen := 1 + publicKeyPrefixLen + bakery.KeyLen + bakery.NonceLen
+		if len(id) < headerLen+box.Overhead {
+			// A short Version3 id is usually a reference to
+			// a payload held in the primary macaroon.
+			return nil, errgo.Newf("caveat id too short (payload not available)")
+		}
+		info := &caveatIdInfo{
+			version: bakery.Version(id[0]),
+		}
+		data := id[1:]
+		info.thirdPartyPublicKey, data = data[:publicKeyPrefixLen], data[publicKeyPrefixLen:]
+		copy(info.firstPartyPublicKey.Key[:], data[:bakery.KeyLen])
+		data = data[bakery.KeyLen:]
+		copy(info.nonce[:], data[:bakery.NonceLen])
+		info.sealed = data[bakery.NonceLen:]
+		return info, nil
+	case 'e':
+		// It's a base64-encoded JSON object.
+		data, err := base64.StdEncoding.DecodeString(string(id))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot base64-decode caveat id")
+		}
+		var wrapper caveatIdJSON
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal caveat id")
+		}
+		if wrapper.ThirdPartyPublicKey == nil || wrapper.FirstPartyPublicKey == nil {
+			return nil, errgo.Newf("public key not specified in caveat id")
+		}
+		sealed, err := base64.StdEncoding.DecodeString(wrapper.Id)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot base64-decode encrypted data")
+		}
+		info := &caveatIdInfo{
+			version:             bakery.Version1,
+			thirdPartyPublicKey: wrapper.ThirdPartyPublicKey.Key[:],
+			firstPartyPublicKey: *wrapper.FirstPartyPublicKey,
+			sealed:              sealed,
+		}
+		if copy(info.nonce[:], wrapper.Nonce) < bakery.NonceLen {
+			return nil, errgo.Newf("nonce too short")
+		}
+		return info, nil
+	}
+	return nil, errgo.Newf("unrecognized caveat id format")
+}
+
+// caveatSecret holds the encrypted part of a third party caveat.
+type caveatSecret struct {
+	rootKey   []byte
+	namespace *checkers.Namespace
+	condition string
+}
+
+// needsThirdPartyKey reports whether decrypting the caveat with
+// the given key pair requires the third party's public key to
+// be provided, which is so when the key pair is that of the first
+// party and the caveat holds only a prefix of the third party's key.
+func (info *caveatIdInfo) needsThirdPartyKey(key *bakery.KeyPair) bool {
+	return key.Public == info.firstPartyPublicKey &&
+		!bytes.HasPrefix(key.Public.Key[:], info.thirdPartyPublicKey) &&
+		len(info.thirdPartyPublicKey) < bakery.KeyLen
+}
+
+// decrypt decrypts the secret part of the caveat with the given
+// key, which must be either the third party's key pair or the key
+// pair of the first party that added the caveat. In the latter
+// case, thirdPartyKey must hold the third party's public key
+// unless the caveat holds all of it (see needsThirdPartyKey).
+func (info *caveatIdInfo) decrypt(key *bakery.KeyPair, thirdPartyKey *bakery.PublicKey) (*caveatSecret, error) {
+	// The encryption is symmetric, so the caveat can be opened with
+	// either party's private key and the other party's public key.
+	var peerKey *bakery.PublicKey
+	switch {
+	case bytes.HasPrefix(key.Public.Key[:], info.thirdPartyPublicKey):
+		peerKey = &info.firstPartyPublicKey
+	case key.Public != info.firstPartyPublicKey:
+		return nil, errgo.Newf("caveat not encrypted for or by public key %s", &key.Public)
+	case len(info.thirdPartyPublicKey) == bakery.KeyLen:
+		peerKey = new(bakery.PublicKey)
+		copy(peerKey.Key[:], info.thirdPartyPublicKey)
+	case thirdPartyKey == nil:
+		return nil, errgo.Newf("third party public key needed to decrypt caveat")
+	case !bytes.HasPrefix(thirdPartyKey.Key[:], info.thirdPartyPublicKey):
+		return nil, errgo.Newf("caveat not encrypted for third party public key %s", thirdPartyKey)
+	default:
+		peerKey = thirdPartyKey
+	}
+	data, ok := box.Open(nil, info.sealed, &info.nonce, (*[bakery.KeyLen]byte)(&peerKey.Key), (*[bakery.KeyLen]byte)(&key.Private.Key))
+	if !ok {
+		return nil, errgo.Newf("cannot decrypt caveat")
+	}
+	if info.version == bakery.Version1 {
+		var record struct {
+			RootKey   []byte
+			Condition string
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal caveat record")
+		}
+		return &caveatSecret{
+			rootKey:   record.RootKey,
+			condition: record.Condition,
+		}, nil
+	}
+	secret, err := decodeCaveatSecret(info.version, data)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid secret part")
+	}
+	return secret, nil
+}
+
+// decodeCaveatSecret decodes the decrypted secret part
+// of a Version2 or Version3 caveat, which holds the
+// following fields:
+//
+//	version [1 byte]
+//	root key length [n: uvarint]
+//	root key [n bytes]
+//	namespace length [n: uvarint] (Version3 only)
+//	namespace [n bytes] (Version3 only)
+//	condition [rest of data]
+func decodeCaveatSecret(version bakery.Version, data []byte) (*caveatSecret, error) {
+	if len(data) < 1 || data[0] != byte(version) {
+		return nil, errgo.Newf("unexpected secret part version")
+	}
+	data = data[1:]
+	var secret caveatSecret
+	var ok bool
+	secret.rootKey, data, ok = readLengthPrefixed(data)
+	if !ok {
+		return nil, errgo.Newf("invalid root key length")
+	}
+	if version >= bakery.Version3 {
+		var nsData []byte
+		nsData, data, ok = readLengthPrefixed(data)
+		if !ok {
+			return nil, errgo.Newf("invalid namespace length")
+		}
+		secret.namespace = new(checkers.Namespace)
+		if err := secret.namespace.UnmarshalText(nsData); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal namespace")
+		}
+	}
+	secret.condition = string(data)
+	return &secret, nil
+}
+
+// readLengthPrefixed reads a uvarint-length-prefixed
+// field from the start of data and returns it along with
+// the remaining data.
+func readLengthPrefixed(data []byte) (field, rest []byte, ok bool) {
+	n, nlen := binary.Uvarint(data)
+	if nlen <= 0 || n > uint64(len(data)-nlen) {
+		return nil, nil, false
+	}
+	data = data[nlen:]
+	return data[:n], data[n:], true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+)
+
+var bakeryVersions = []bakery.Version{
+	bakery.Version1,
+	bakery.Version2,
+	bakery.Version3,
+}
+
+func TestDecodeMacaroonId(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	rks := bakery.NewMemRootKeyStore()
+	oven := bakery.NewOven(bakery.OvenParams{
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return rks
+		},
+	})
+	for _, version := range bakeryVersions {
+		c.Run(fmt.Sprintf("version%d", version), func(c *qt.C) {
+			m, err := oven.NewMacaroon(ctx, version, time.Now().Add(time.Hour), nil, readOp)
+			c.Assert(err, qt.Equals, nil)
+			info, err := decodeMacaroonId(m.M().Id())
+			c.Assert(err, qt.Equals, nil)
+			// The oven always creates the latest id format,
+			// base64-encoding it for old macaroon versions.
+			c.Assert(info.version, qt.Equals, bakery.LatestVersion)
+			c.Assert(info.nonce, qt.HasLen, 16)
+			c.Assert(info.ops, qt.DeepEquals, []bakery.Op{readOp})
+			_, ok := info.opsStoreKey()
+			c.Assert(ok, qt.Equals, false)
+			_, err = rks.Get(ctx, info.rootKeyId)
+			c.Assert(err, qt.Equals, nil)
+		})
+	}
+
+	_, err := decodeMacaroonId([]byte("not a bakery id"))
+	c.Assert(err, qt.ErrorMatches, `unrecognized id format`)
+}
+
+func TestDecodeCaveatId(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	firstPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	thirdPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	otherKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	rootKey := []byte("root key")
+	for _, version := range bakeryVersions {
+		c.Run(fmt.Sprintf("version%d", version), func(c *qt.C) {
+			locator := bakery.NewThirdPartyStore()
+			locator.AddInfo("third-party", bakery.ThirdPartyInfo{
+				PublicKey: thirdPartyKey.Public,
+				Version:   version,
+			})
+			m, err := bakery.NewMacaroon(rootKey, []byte("id"), "", version, checkers.New(nil).Namespace())
+			c.Assert(err, qt.Equals, nil)
+			err = m.AddCaveat(ctx, checkers.Caveat{
+				Location:  "third-party",
+				Condition: "is-ok",
+			}, firstPartyKey, locator)
+			c.Assert(err, qt.Equals, nil)
+			cav := m.M().Caveats()[0]
+			payloads, err := caveatPayloads(m)
+			c.Assert(err, qt.Equals, nil)
+			payload, ok := payloads[string(cav.Id)]
+			c.Assert(ok, qt.Equals, version >= bakery.Version3)
+			if !ok {
+				payload = cav.Id
+			}
+
+			info, err := decodeCaveatId(payload)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(info.version, qt.Equals, version)
+			c.Assert(info.firstPartyPublicKey, qt.Equals, firstPartyKey.Public)
+			c.Assert(bytes.HasPrefix(thirdPartyKey.Public.Key[:], info.thirdPartyPublicKey), qt.Equals, true)
+
+			// The third party can decrypt the caveat.
+			c.Assert(info.needsThirdPartyKey(thirdPartyKey), qt.Equals, false)
+			secret, err := info.decrypt(thirdPartyKey, nil)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(secret.condition, qt.Equals, "is-ok")
+			c.Assert(secret.namespace != nil, qt.Equals, version >= bakery.Version3)
+
+			// The decrypted root key can be used to discharge the caveat.
+			dm, err := bakery.NewMacaroon(secret.rootKey, cav.Id, "third-party", version, nil)
+			c.Assert(err, qt.Equals, nil)
+			dm.M().Bind(m.M().Signature())
+			err = m.M().Verify(rootKey, func(string) error { return nil }, []*macaroon.Macaroon{dm.M()})
+			c.Assert(err, qt.Equals, nil)
+
+			// So can the first party, given the third party's public key
+			// when the caveat doesn't hold all of it.
+			c.Assert(info.needsThirdPartyKey(firstPartyKey), qt.Equals, version >= bakery.Version2)
+			if version >= bakery.Version2 {
+				_, err = info.decrypt(firstPartyKey, nil)
+				c.Assert(err, qt.ErrorMatches, `third party public key needed to decrypt caveat`)
+				_, err = info.decrypt(firstPartyKey, &otherKey.Public)
+				c.Assert(err, qt.ErrorMatches, `caveat not encrypted for third party public key .*`)
+			}
+			secret1, err := info.decrypt(firstPartyKey, &thirdPartyKey.Public)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(secret1.rootKey, qt.DeepEquals, secret.rootKey)
+			c.Assert(secret1.condition, qt.Equals, secret.condition)
+			c.Assert(secret1.namespace.String(), qt.Equals, secret.namespace.String())
+
+			// Nobody else can.
+			_, err = info.decrypt(otherKey, &thirdPartyKey.Public)
+			c.Assert(err, qt.ErrorMatches, `caveat not encrypted for or by public key .*`)
+		})
+	}
+
+	_, err = decodeCaveatId([]byte("not a caveat id"))
+	c.Assert(err, qt.ErrorMatches, `unrecognized caveat id format`)
+}
+
+func TestIdDecoderWriteCaveatId(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	firstPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	thirdPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	locator := bakery.NewThirdPartyStore()
+	locator.AddInfo("third-party", bakery.ThirdPartyInfo{
+		PublicKey: thirdPartyKey.Public,
+		Version:   bakery.Version2,
+	})
+	m, err := bakery.NewMacaroon([]byte("root key"), []byte("id"), "", bakery.Version2, nil)
+	c.Assert(err, qt.Equals, nil)
+	err = m.AddCaveat(ctx, checkers.Caveat{
+		Location:  "third-party",
+		Condition: "is-ok",
+	}, firstPartyKey, locator)
+	c.Assert(err, qt.Equals, nil)
+	id := m.M().Caveats()[0].Id
+	header := fmt.Sprintf("\t\tversion: 2\n\t\tthird party public key prefix: %x\n\t\tfirst party public key: %s\n\t\tnonce: %x\n",
+		thirdPartyKey.Public.Key[:publicKeyPrefixLen], &firstPartyKey.Public, id[1+publicKeyPrefixLen+bakery.KeyLen:][:bakery.NonceLen])
+
+	// The third party's public key is found with the locator.
+	var buf bytes.Buffer
+	d := &idDecoder{
+		key:     firstPartyKey,
+		locator: locator,
+	}
+	d.writeCaveatId(ctx, &buf, "third-party", id)
+	c.Assert(buf.String(), qt.Equals, header+"\t\tcondition: is-ok\n")
+
+	// The public key takes precedence over the locator.
+	buf.Reset()
+	d.thirdPartyKey = &thirdPartyKey.Public
+	d.writeCaveatId(ctx, &buf, "elsewhere", id)
+	c.Assert(buf.String(), qt.Equals, header+"\t\tcondition: is-ok\n")
+
+	buf.Reset()
+	d.thirdPartyKey = nil
+	d.writeCaveatId(ctx, &buf, "elsewhere", id)
+	c.Assert(strings.HasPrefix(buf.String(), header), qt.Equals, true)
+	c.Assert(strings.TrimPrefix(buf.String(), header), qt.Matches, `\t\tcannot decrypt: cannot get public key for third party "elsewhere": .*\n`)
+
+	buf.Reset()
+	d.locator = nil
+	d.writeCaveatId(ctx, &buf, "third-party", id)
+	c.Assert(buf.String(), qt.Equals, header+"\t\tcannot decrypt: no public key for third party \"third-party\"\n")
+}
@@ -11,8 +11,9 @@ import (
 )
 
 type newCommand struct {
-	ops    []bakery.Op
-	expiry time.Duration
+	ops       []bakery.Op
+	expiry    time.Duration
+	namespace namespaceFlag
 }
 
 func init() {
@@ -31,6 +32,7 @@ func (c *newCommand) Info() *cmd.Info {
 func (c *newCommand) SetFlags(f *gnuflag.FlagSet) {
 	// TODO allow specification of root key and id?
 	f.DurationVar(&c.expiry, "expiry", time.Hour, "expiry time of macaroon as a duration")
+	f.Var(&c.namespace, "namespace", "comma-separated caveat namespaces in uri:prefix form to embed in the macaroon")
 }
 
 func (c *newCommand) IsSuperCommand() bool {
@@ -54,12 +56,12 @@ func (c *newCommand) Init(args []string) error {
 }
 
 func (c *newCommand) Run(cmdCtx *cmd.Context) error {
-	oven, err := newOven(cmdCtx)
+	oven, err := newOven(cmdCtx, c.namespace.ns, true)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	ctx := context.Background()
-	m, err := oven.NewMacaroon(ctx, bakery.Version3, time.Now().Add(c.expiry).Round(time.Millisecond), nil, c.ops...)
+	expiry := time.Now().Add(c.expiry).Round(time.Millisecond)
+	m, err := oven.NewMacaroon(context.Background(), bakery.Version3, expiry, nil, c.ops...)
 	if err != nil {
 		return errgo.Mask(err)
 	}
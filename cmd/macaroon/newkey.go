@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery/agent"
+)
+
+type newkeyCommand struct {
+	store  bool
+	agents agentsFlag
+}
+
+func init() {
+	register(&newkeyCommand{})
+}
+
+func (c *newkeyCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "newkey",
+		Purpose: "Generate a new public-private key pair",
+		Doc: `
+The newkey command generates a new key pair and prints
+it in JSON format.
+
+If --store is specified, the key pair replaces the one kept
+in the key store associated with the current access token,
+which is used when adding third party caveats, and only
+the public key is printed.
+
+If one or more --agent flags are specified, an agent
+file holding the new key is printed instead. Each flag
+holds a URL prefix and a username separated by "=".
+The agent file can be used with "macaroon discharge
+--agent-file" to authenticate non-interactively, for example:
+
+	macaroon newkey --agent https://idm.example.com=bob > agent.json
+`,
+	}
+}
+
+func (c *newkeyCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.BoolVar(&c.store, "store", false, "store the key pair instead of printing it")
+	f.Var(&c.agents, "agent", "print an agent file for the given url=username (may be repeated)")
+}
+
+func (c *newkeyCommand) Init(args []string) error {
+	if len(args) != 0 {
+		return errgo.Newf("unexpected arguments")
+	}
+	if c.store && len(c.agents) > 0 {
+		return errgo.Newf("cannot specify both --store and --agent")
+	}
+	return nil
+}
+
+func (c *newkeyCommand) Run(cmdCtx *cmd.Context) error {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(c.agents) > 0 {
+		data, err := json.MarshalIndent(&agent.AuthInfo{
+			Key:    key,
+			Agents: c.agents,
+		}, "", "\t")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Fprintf(cmdCtx.Stdout, "%s\n", data)
+		return nil
+	}
+	if !c.store {
+		data, err := json.MarshalIndent(key, "", "\t")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Fprintf(cmdCtx.Stdout, "%s\n", data)
+		return nil
+	}
+	ks, err := newKeyStore(cmdCtx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ks.SetKeyPair(context.Background(), key); err != nil {
+		return errgo.Notef(err, "cannot store key pair")
+	}
+	fmt.Fprintf(cmdCtx.Stdout, "%s\n", key.Public.String())
+	return nil
+}
+
+func (c *newkeyCommand) IsSuperCommand() bool {
+	return false
+}
+
+func (c *newkeyCommand) AllowInterspersedFlags() bool {
+	return false
+}
+
+// agentsFlag implements gnuflag.Value by appending
+// an agent in url=username form for each use of the flag.
+type agentsFlag []agent.Agent
+
+func (f *agentsFlag) String() string {
+	s := make([]string, len(*f))
+	for i, a := range *f {
+		s[i] = a.URL + "=" + a.Username
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *agentsFlag) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return errgo.Newf("invalid agent %q (must be in url=username form)", s)
+	}
+	*f = append(*f, agent.Agent{
+		URL:      s[:i],
+		Username: s[i+1:],
+	})
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/macaroon-cmd/cmd/macaroond/macaroondclient"
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+type passwdCommand struct {
+	serverFlags
+	invalidate bool
+}
+
+func init() {
+	register(&passwdCommand{})
+}
+
+func (c *passwdCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "passwd",
+		Purpose: "Change the password of the macaroond server",
+		Doc: `
+The passwd command changes the password that protects
+the root keys held by the macaroond server. It prompts for
+the current password and the new one.
+
+If --invalidate is specified, all access tokens issued
+by the server will stop working, and it will be necessary
+to use "macaroon login" again.
+`,
+	}
+}
+
+func (c *passwdCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.serverFlags.SetFlags(f)
+	f.BoolVar(&c.invalidate, "invalidate", false, "invalidate all existing access tokens")
+}
+
+func (c *passwdCommand) Init(args []string) error {
+	if len(args) != 0 {
+		return errgo.Newf("unexpected arguments")
+	}
+	return nil
+}
+
+func (c *passwdCommand) Run(cmdCtx *cmd.Context) error {
+	ctx := context.Background()
+	client, err := macaroondclient.New(c.server, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	oldPw, err := readPassword(cmdCtx, "Old password: ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	newPw1, err := readPassword(cmdCtx, "New password: ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	newPw2, err := readPassword(cmdCtx, "Same password: ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if newPw1 != newPw2 {
+		return errgo.Newf("Password mismatch")
+	}
+	if err := client.SetPassword(ctx, &params.SetPasswordRequest{
+		OldPassword:      oldPw,
+		NewPassword:      newPw1,
+		InvalidateTokens: c.invalidate,
+	}); err != nil {
+		return errgo.Notef(err, "cannot change password")
+	}
+	if c.invalidate {
+		fmt.Fprintf(cmdCtx.Stderr, "Password changed; use \"macaroon login\" to obtain a new access token\n")
+	}
+	return nil
+}
+
+func (c *passwdCommand) IsSuperCommand() bool {
+	return false
+}
+
+func (c *passwdCommand) AllowInterspersedFlags() bool {
+	return false
+}
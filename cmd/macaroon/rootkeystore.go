@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/juju/cmd"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 	macaroon "gopkg.in/macaroon.v2-unstable"
 
 	"github.com/rogpeppe/macaroon-cmd/cmd/macaroond/macaroondclient"
+	"github.com/rogpeppe/macaroon-cmd/opcheck"
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
 )
 
 var errNoAccessToken = errgo.Newf(`no macaroon access token found - use "macaroon login" to obtain one`)
@@ -22,26 +30,217 @@ var _ bakery.RootKeyStore = (*fileRootKeyStore)(nil)
 
 const envToken = "MACAROON_ACCESS_TOKEN"
 
-func newRootKeyStore() (bakery.RootKeyStore, error) {
+// oven is implemented by the types that create and check
+// macaroons on behalf of the commands.
+type oven interface {
+	// NewMacaroon creates a new macaroon with the given
+	// operations, as for bakery.Oven.NewMacaroon. Only
+	// first party caveats may be added.
+	NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, ops ...bakery.Op) (*bakery.Macaroon, error)
+
+	// CheckMacaroons checks that the given macaroons allow
+	// all the given operations in the given context, resolving
+	// conditions with the oven's namespace. Conditions named
+	// by the given policy, which may be nil, are checked against
+	// it. The result holds any first party caveat conditions that
+	// were not recognized and the attributes declared
+	// by the macaroons, as returned by the macaroond server.
+	// If the operations are not allowed, the returned
+	// error has a params.ErrVerificationFailed cause.
+	CheckMacaroons(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) (*params.CheckMacaroonResponse, error)
+
+	// CheckOps is like CheckMacaroons except that it checks
+	// each operation separately and returns the status of each
+	// one. It does not return an error when operations are
+	// not allowed.
+	CheckOps(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) ([]params.OpStatus, error)
+}
+
+// newOven returns an oven that uses the access token
+// in the environment. When the token refers to a macaroond
+// server, macaroons are minted and verified by the server,
+// so the root keys are never seen by the command.
+// New macaroons hold the given namespace, which is also
+// used to resolve caveat conditions when checking macaroons.
+// If it is nil, the standard namespace is used; otherwise
+// the standard namespace is added to it if not present.
+//
+// If prompt is true, the oven prompts for the password when the
+// macaroond server is locked. Otherwise its methods return an
+// error with a params.ErrLocked cause.
+func newOven(cmdCtx *cmd.Context, ns *checkers.Namespace, prompt bool) (oven, error) {
+	if ns != nil {
+		ns.Register(checkers.StdNamespace, "")
+	}
 	tok := os.Getenv(envToken)
 	if tok == "" {
 		return nil, errNoAccessToken
 	}
 	if path := strings.TrimPrefix(tok, "localfile:"); len(path) != len(tok) {
-		return newFileRootKeyStore(path), nil
+		key, err := newFileKeyStore(keyPairPath(path)).KeyPair(context.Background())
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get key pair")
+		}
+		return newLocalOven(newFileRootKeyStore(path), key, ns), nil
 	}
+	client, err := newDaemonClient(cmdCtx, tok)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &daemonOven{
+		client: client,
+		cmdCtx: cmdCtx,
+		ns:     ns,
+		prompt: prompt,
+	}, nil
+}
+
+// newDaemonClient returns a client that talks to the
+// macaroond server using the given access token.
+// Any third party caveats that have been added to
+// the token are discharged when the client is first
+// used, caching the discharges for later commands.
+func newDaemonClient(cmdCtx *cmd.Context, tok string) (*macaroondclient.Client, error) {
 	ms, err := parseUnboundMacaroons(tok)
 	if err != nil {
 		return nil, errgo.Notef(err, "invalid macaroon access token")
 	}
-	macLoc := ms[0].M().Location()
-	loc := strings.SplitN(macLoc, " ", 2)
-	if len(loc) != 2 {
-		return nil, errgo.Notef(err, "access token location %q in incorrect format", macLoc)
+	serverParams, err := macaroondclient.ParseLocation(ms[0].M().Location())
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid access token")
+	}
+	serverParams.Discharger = &lazyDischarger{
+		cmdCtx: cmdCtx,
+	}
+	client, err := macaroondclient.New(serverParams, ms)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return client, nil
+}
+
+// daemonOven implements oven by using a macaroond client.
+// If the server is locked and prompt is true, it prompts
+// for the password to unlock it.
+type daemonOven struct {
+	client *macaroondclient.Client
+	cmdCtx *cmd.Context
+	ns     *checkers.Namespace
+	prompt bool
+}
+
+// NewMacaroon implements oven.NewMacaroon.
+func (o *daemonOven) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, ops ...bakery.Op) (*bakery.Macaroon, error) {
+	if o.ns != nil {
+		ctx = macaroondclient.ContextWithNamespace(ctx, o.ns)
+	}
+	var m *bakery.Macaroon
+	err := o.withUnlock(ctx, func() error {
+		var err error
+		m, err = o.client.NewMacaroon(ctx, version, expiry, caveats, ops...)
+		return err
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return m, nil
+}
+
+// CheckMacaroons implements oven.CheckMacaroons.
+func (o *daemonOven) CheckMacaroons(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) (*params.CheckMacaroonResponse, error) {
+	var resp *params.CheckMacaroonResponse
+	err := o.withUnlock(ctx, func() error {
+		var err error
+		resp, err = o.client.CheckMacaroons(ctx, mss, ops, checkCtx, o.ns, pol)
+		return err
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrVerificationFailed), errgo.Is(params.ErrLocked))
+	}
+	return resp, nil
+}
+
+// CheckOps implements oven.CheckOps.
+func (o *daemonOven) CheckOps(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) ([]params.OpStatus, error) {
+	var statuses []params.OpStatus
+	err := o.withUnlock(ctx, func() error {
+		var err error
+		statuses, err = o.client.CheckOps(ctx, mss, ops, checkCtx, o.ns, pol)
+		return err
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return statuses, nil
+}
+
+// withUnlock calls f, unlocking the server and trying
+// again if it fails because the server is locked and
+// o.prompt is true.
+func (o *daemonOven) withUnlock(ctx context.Context, f func() error) error {
+	err := f()
+	if errgo.Cause(err) != params.ErrLocked || !o.prompt {
+		return err
+	}
+	fmt.Fprintf(o.cmdCtx.Stderr, "The macaroond server is locked.\n")
+	pw, err := readPassword(o.cmdCtx, "Password: ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := o.client.Unlock(ctx, &params.UnlockRequest{
+		Password: pw,
+	}); err != nil {
+		return errgo.Notef(err, "cannot unlock server")
+	}
+	return f()
+}
+
+// localOven implements oven by using a local root key store.
+type localOven struct {
+	oven *bakery.Oven
+	ns   *checkers.Namespace
+}
+
+// newLocalOven returns an oven that uses the given root key store.
+// The given key is used to encrypt any third party caveats.
+// The namespace may be nil, as for newOven.
+func newLocalOven(rks bakery.RootKeyStore, key *bakery.KeyPair, ns *checkers.Namespace) *localOven {
+	return &localOven{
+		oven: bakery.NewOven(bakery.OvenParams{
+			RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+				return rks
+			},
+			Namespace: ns,
+			Key:       key,
+			Locator:   httpbakery.NewThirdPartyLocator(nil, nil),
+		}),
+		ns: ns,
+	}
+}
+
+// NewMacaroon implements oven.NewMacaroon.
+func (o *localOven) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, ops ...bakery.Op) (*bakery.Macaroon, error) {
+	return o.oven.NewMacaroon(ctx, version, expiry, caveats, ops...)
+}
+
+// CheckMacaroons implements oven.CheckMacaroons.
+func (o *localOven) CheckMacaroons(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) (*params.CheckMacaroonResponse, error) {
+	// The macaroons are checked in the same way
+	// that the macaroond server checks them.
+	resp, err := opcheck.CheckOps(params.ContextWithCheckContext(ctx, checkCtx), o.oven, mss, ops, o.ns, pol)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrVerificationFailed))
+	}
+	return resp, nil
+}
+
+// CheckOps implements oven.CheckOps.
+func (o *localOven) CheckOps(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, pol *policy.Policy) ([]params.OpStatus, error) {
+	statuses, err := opcheck.CheckEachOp(params.ContextWithCheckContext(ctx, checkCtx), o.oven, mss, ops, o.ns, pol)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
-	netw, addr := loc[0], loc[1]
-	// TODO discharge macaroons, as someone may have added 3rd party caveats to them.
-	return macaroondclient.New(netw, addr, ms.Bind()), nil
+	return statuses, nil
 }
 
 // newFileRootKeyStore returns an implementation of
@@ -54,8 +253,6 @@ func newFileRootKeyStore(path string) bakery.RootKeyStore {
 }
 
 // TODO encrypt key at rest.
-// TODO use a server that implements an oven-like API, so
-// the command line apps never need to see the root keys.
 
 type fileRootKeyStore struct {
 	path string
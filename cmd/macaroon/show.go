@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/juju/cmd"
 	"github.com/juju/gnuflag"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 	macaroon "gopkg.in/macaroon.v2-unstable"
 )
 
 type showCommand struct {
 	format           formatFlag
+	decode           bool
+	publicKey        publicKeyFlag
+	insecure         bool
 	unboundMacaroons bakery.Slice
 	boundMacaroons   macaroon.Slice
 }
@@ -26,15 +39,46 @@ func (c *showCommand) Info() *cmd.Info {
 		Name:    "show",
 		Args:    "macaroons",
 		Purpose: "Print macaroons in different formats",
-		Doc:     `doc TODO`,
+		Doc: `
+The show command prints the given macaroons in the format given
+by --format, which may be json, binary, rawjson, rawbinary
+or text.
+
+The text format prints a human-readable description of each
+macaroon in the slice, including its location, its id decoded
+into bakery version, root key id and operations where possible,
+its first party caveats, with expiry times shown in local time
+and relative to now, and its third party caveats, with whether a
+matching discharge macaroon is present. It also shows whether the
+discharge macaroons have been bound to the primary macaroon.
+
+The --decode flag implies the text format and also takes apart
+the bakery-specific encodings of the ids: the primary macaroon
+id is shown with its nonce, root key id and operations (or the
+key of the operations in the ops store), and each third party
+caveat id is shown with its version, the prefix of the third
+party public key and the first party public key. If the local
+key pair from the key store (see MACAROON_ACCESS_TOKEN) is the
+one the caveat was encrypted for, or the one it was added with,
+the caveat condition is decrypted and shown too. Decrypting a
+caveat that was added with the local key needs the third party's
+full public key, which is taken from --public-key if specified
+or discovered from the caveat location otherwise (see also
+--insecure). Note that caveat ids in bound version 3 macaroons
+don't hold the encrypted part, so only unbound macaroons can
+be decoded fully.
+`,
 	}
 }
 
 func (c *showCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.format = formatJSON | formatRaw
 
-	f.Var(&c.format, "f", "Format to print bound macaroons in")
+	f.Var(&c.format, "f", "Format to print bound macaroons in (json, binary, rawjson, rawbinary or text)")
 	f.Var(&c.format, "format", "")
+	f.BoolVar(&c.decode, "decode", false, "Print text format with bakery ids and caveats decoded")
+	f.Var(&c.publicKey, "public-key", "With --decode, base64 public key of the third party of caveats added with the local key (discovered automatically if not specified)")
+	f.BoolVar(&c.insecure, "insecure", false, "allow non-secure public key retrieval (intended only for testing)")
 }
 
 func (c *showCommand) Init(args []string) error {
@@ -50,6 +94,34 @@ func (c *showCommand) Init(args []string) error {
 }
 
 func (c *showCommand) Run(cmdCtx *cmd.Context) error {
+	ctx := context.Background()
+	if c.decode {
+		key, err := localKey(cmdCtx)
+		if err != nil {
+			fmt.Fprintf(cmdCtx.Stderr, "cannot get local key pair, so caveats will not be decrypted: %v\n", err)
+		}
+		d := &idDecoder{
+			key:           key,
+			thirdPartyKey: c.publicKey.key,
+		}
+		if d.thirdPartyKey == nil {
+			loc := httpbakery.NewThirdPartyLocator(nil, nil)
+			if c.insecure {
+				loc.AllowInsecure()
+			}
+			d.locator = loc
+		}
+		if err := c.writeText(ctx, cmdCtx.Stdout, d); err != nil {
+			return errgo.Mask(err)
+		}
+		return nil
+	}
+	if c.format == formatText {
+		if err := c.writeText(ctx, cmdCtx.Stdout, nil); err != nil {
+			return errgo.Mask(err)
+		}
+		return nil
+	}
 	// TODO provide a way of formatting the JSON prettily.
 	var data []byte
 	switch {
@@ -66,12 +138,278 @@ func (c *showCommand) Run(cmdCtx *cmd.Context) error {
 			return errgo.Mask(err)
 		}
 	default:
-		panic("unreachable")
+		return errgo.New("no macaroons")
 	}
 	cmdCtx.Stdout.Write(data)
 	return nil
 }
 
+// writeText writes a human-readable description of the macaroons.
+// If d is non-nil, it is used to decode the bakery ids.
+func (c *showCommand) writeText(ctx context.Context, w io.Writer, d *idDecoder) error {
+	var ms macaroon.Slice
+	var nss []*checkers.Namespace
+	// payloads holds the third party caveat payloads
+	// of each macaroon, keyed by caveat id.
+	var payloads []map[string][]byte
+	bound := len(c.boundMacaroons) > 0
+	if bound {
+		// Bound macaroons don't record their namespace,
+		// so assume the standard one.
+		ms = c.boundMacaroons
+		ns := checkers.New(nil).Namespace()
+		nss = make([]*checkers.Namespace, len(ms))
+		for i := range nss {
+			nss[i] = ns
+		}
+	} else {
+		for _, m := range c.unboundMacaroons {
+			ms = append(ms, m.M())
+			nss = append(nss, m.Namespace())
+			cdata, err := caveatPayloads(m)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			payloads = append(payloads, cdata)
+		}
+	}
+	if len(ms) == 0 {
+		return errgo.New("no macaroons")
+	}
+	// dischargeIndex maps from caveat id to the index
+	// of the discharge macaroon for that caveat.
+	dischargeIndex := make(map[string]int)
+	for i, m := range ms[1:] {
+		dischargeIndex[string(m.Id())] = i + 1
+	}
+	now := time.Now()
+	for i, m := range ms {
+		kind := "primary"
+		if i > 0 {
+			kind = "discharge"
+		}
+		fmt.Fprintf(w, "macaroon %d (%s)\n", i+1, kind)
+		fmt.Fprintf(w, "\tlocation: %s\n", m.Location())
+		switch {
+		case i == 0 && d != nil:
+			d.writeMacaroonId(w, m.Id())
+		case i == 0:
+			fmt.Fprintf(w, "\tid: %s\n", describeMacaroonId(m.Id()))
+		default:
+			fmt.Fprintf(w, "\tid: %s\n", formatBytes(m.Id()))
+		}
+		if !bound && nss[i] != nil {
+			fmt.Fprintf(w, "\tnamespace: %s\n", nss[i])
+		}
+		for _, cav := range m.Caveats() {
+			if len(cav.VerificationId) == 0 {
+				fmt.Fprintf(w, "\tcaveat: %s\n", describeCondition(nss[i], string(cav.Id), now))
+				continue
+			}
+			discharge := "no discharge"
+			if j, ok := dischargeIndex[string(cav.Id)]; ok {
+				discharge = fmt.Sprintf("discharged by macaroon %d", j+1)
+			}
+			fmt.Fprintf(w, "\tthird party caveat: location %s (%s)\n", cav.Location, discharge)
+			if d != nil {
+				payload := cav.Id
+				if !bound {
+					if p, ok := payloads[i][string(cav.Id)]; ok {
+						payload = p
+					}
+				}
+				d.writeCaveatId(ctx, w, cav.Location, payload)
+			}
+		}
+	}
+	switch {
+	case len(ms) == 1:
+	case bound:
+		fmt.Fprintf(w, "discharges are bound to the primary macaroon\n")
+	default:
+		fmt.Fprintf(w, "discharges are not bound to the primary macaroon (see the use command)\n")
+	}
+	return nil
+}
+
+// idDecoder writes descriptions of decoded bakery ids.
+type idDecoder struct {
+	// key holds the local key pair used to decrypt
+	// third party caveats. It may be nil.
+	key *bakery.KeyPair
+
+	// thirdPartyKey holds the public key of the third party
+	// of caveats added with key. If it's nil, the key is
+	// found with locator, if that's non-nil.
+	thirdPartyKey *bakery.PublicKey
+	locator       bakery.ThirdPartyLocator
+}
+
+// writeMacaroonId writes a description of the given
+// primary macaroon id, with one field per line.
+func (d *idDecoder) writeMacaroonId(w io.Writer, id []byte) {
+	info, err := decodeMacaroonId(id)
+	if err != nil {
+		fmt.Fprintf(w, "\tid: %s\n", formatBytes(id))
+		fmt.Fprintf(w, "\t\tcannot decode: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "\tid: version %d\n", info.version)
+	if len(info.nonce) > 0 {
+		fmt.Fprintf(w, "\t\tnonce: %x\n", info.nonce)
+	}
+	fmt.Fprintf(w, "\t\troot key id: %s\n", formatBytes(info.rootKeyId))
+	if key, ok := info.opsStoreKey(); ok {
+		fmt.Fprintf(w, "\t\tops store key: %s\n", key)
+		return
+	}
+	for _, op := range info.ops {
+		fmt.Fprintf(w, "\t\top: %s:%s\n", op.Action, op.Entity)
+	}
+}
+
+// writeCaveatId writes a description of the given third
+// party caveat id or payload, decrypting its condition
+// if it was encrypted for or by d.key. The location
+// is that of the caveat's third party.
+func (d *idDecoder) writeCaveatId(ctx context.Context, w io.Writer, location string, id []byte) {
+	info, err := decodeCaveatId(id)
+	if err != nil {
+		fmt.Fprintf(w, "\t\tcannot decode caveat id: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "\t\tversion: %d\n", info.version)
+	if info.version == bakery.Version1 {
+		fmt.Fprintf(w, "\t\tthird party public key: %s\n", base64.StdEncoding.EncodeToString(info.thirdPartyPublicKey))
+	} else {
+		fmt.Fprintf(w, "\t\tthird party public key prefix: %x\n", info.thirdPartyPublicKey)
+	}
+	fmt.Fprintf(w, "\t\tfirst party public key: %s\n", &info.firstPartyPublicKey)
+	fmt.Fprintf(w, "\t\tnonce: %x\n", info.nonce)
+	if d.key == nil {
+		return
+	}
+	var thirdPartyKey *bakery.PublicKey
+	if info.needsThirdPartyKey(d.key) {
+		thirdPartyKey, err = d.thirdPartyPublicKey(ctx, location)
+		if err != nil {
+			fmt.Fprintf(w, "\t\tcannot decrypt: %v\n", err)
+			return
+		}
+	}
+	secret, err := info.decrypt(d.key, thirdPartyKey)
+	if err != nil {
+		fmt.Fprintf(w, "\t\tcannot decrypt: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "\t\tcondition: %s\n", secret.condition)
+	if secret.namespace != nil {
+		fmt.Fprintf(w, "\t\tnamespace: %s\n", secret.namespace)
+	}
+}
+
+// thirdPartyPublicKey returns the public key of the
+// third party at the given location.
+func (d *idDecoder) thirdPartyPublicKey(ctx context.Context, location string) (*bakery.PublicKey, error) {
+	if d.thirdPartyKey != nil {
+		return d.thirdPartyKey, nil
+	}
+	if d.locator == nil {
+		return nil, errgo.Newf("no public key for third party %q", location)
+	}
+	info, err := d.locator.ThirdPartyInfo(ctx, location)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get public key for third party %q", location)
+	}
+	return &info.PublicKey, nil
+}
+
+// caveatPayloads returns the third party caveat payloads held in
+// the given macaroon, keyed by caveat id. The bakery doesn't
+// provide access to them directly, so they're taken from the
+// macaroon's JSON encoding.
+func caveatPayloads(m *bakery.Macaroon) (map[string][]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var mjson struct {
+		CaveatData map[string]string `json:"cdata"`
+	}
+	if err := json.Unmarshal(data, &mjson); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	payloads := make(map[string][]byte)
+	for id64, data64 := range mjson.CaveatData {
+		id, err := base64.RawURLEncoding.DecodeString(id64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid caveat id in caveat data")
+		}
+		data, err := base64.RawURLEncoding.DecodeString(data64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid caveat data")
+		}
+		payloads[string(id)] = data
+	}
+	return payloads, nil
+}
+
+// describeMacaroonId returns a description of the
+// information in the given primary macaroon id.
+func describeMacaroonId(id []byte) string {
+	info, err := decodeMacaroonId(id)
+	if err != nil {
+		return formatBytes(id)
+	}
+	desc := fmt.Sprintf("version %d, root key id %s", info.version, formatBytes(info.rootKeyId))
+	if len(info.ops) > 0 {
+		ops := make([]string, len(info.ops))
+		for i, op := range info.ops {
+			ops[i] = op.Action + ":" + op.Entity
+		}
+		desc += ", ops " + strings.Join(ops, " ")
+	}
+	return desc
+}
+
+// describeCondition returns a description of the given
+// first party caveat condition, resolved with the given
+// namespace. Time-before conditions are shown with the
+// time in now's location and relative to now.
+func describeCondition(ns *checkers.Namespace, cond string, now time.Time) string {
+	prefix, ok := ns.Resolve(checkers.StdNamespace)
+	if !ok {
+		return cond
+	}
+	name, arg, err := checkers.ParseCaveat(cond)
+	if err != nil || name != checkers.ConditionWithPrefix(prefix, checkers.CondTimeBefore) {
+		return cond
+	}
+	t, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil {
+		return cond
+	}
+	when := t.In(now.Location()).Format("2006-01-02 15:04:05 MST")
+	d := t.Sub(now).Round(time.Second)
+	if d > 0 {
+		return fmt.Sprintf("%s (expires %s, in %v)", cond, when, d)
+	}
+	return fmt.Sprintf("%s (expired %s, %v ago)", cond, when, -d)
+}
+
+// formatBytes formats the given bytes as a quoted
+// string if they're printable, or in hex otherwise.
+func formatBytes(b []byte) string {
+	if utf8.Valid(b) && strings.IndexFunc(string(b), isNotPrint) == -1 {
+		return strconv.Quote(string(b))
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func isNotPrint(r rune) bool {
+	return !unicode.IsPrint(r)
+}
+
 func (c *showCommand) IsSuperCommand() bool {
 	return false
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+)
+
+func TestShowWriteText(t *testing.T) {
+	c := qt.New(t)
+	ns := checkers.New(nil).Namespace()
+	m, err := bakery.NewMacaroon([]byte("root key"), []byte("primary id"), "somewhere", bakery.LatestVersion, ns)
+	c.Assert(err, qt.Equals, nil)
+	err = m.AddCaveat(context.Background(), checkers.DeclaredCaveat("user", "bob"), nil, nil)
+	c.Assert(err, qt.Equals, nil)
+	err = m.M().AddThirdPartyCaveat([]byte("discharge root key"), []byte("caveat id"), "https://example.com")
+	c.Assert(err, qt.Equals, nil)
+	dm, err := bakery.NewMacaroon([]byte("discharge root key"), []byte("caveat id"), "https://example.com", bakery.LatestVersion, ns)
+	c.Assert(err, qt.Equals, nil)
+
+	var buf bytes.Buffer
+	cmd := &showCommand{
+		unboundMacaroons: bakery.Slice{m},
+	}
+	err = cmd.writeText(context.Background(), &buf, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buf.String(), qt.Equals, `macaroon 1 (primary)
+	location: somewhere
+	id: "primary id"
+	namespace: std:
+	caveat: declared user bob
+	third party caveat: location https://example.com (no discharge)
+`)
+
+	buf.Reset()
+	cmd = &showCommand{
+		unboundMacaroons: bakery.Slice{m, dm},
+	}
+	err = cmd.writeText(context.Background(), &buf, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buf.String(), qt.Equals, `macaroon 1 (primary)
+	location: somewhere
+	id: "primary id"
+	namespace: std:
+	caveat: declared user bob
+	third party caveat: location https://example.com (discharged by macaroon 2)
+macaroon 2 (discharge)
+	location: https://example.com
+	id: "caveat id"
+	namespace: std:
+discharges are not bound to the primary macaroon (see the use command)
+`)
+
+	buf.Reset()
+	cmd = &showCommand{
+		boundMacaroons: macaroon.Slice{m.M(), dm.M()},
+	}
+	err = cmd.writeText(context.Background(), &buf, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buf.String(), qt.Equals, `macaroon 1 (primary)
+	location: somewhere
+	id: "primary id"
+	caveat: declared user bob
+	third party caveat: location https://example.com (discharged by macaroon 2)
+macaroon 2 (discharge)
+	location: https://example.com
+	id: "caveat id"
+discharges are bound to the primary macaroon
+`)
+
+	err = (&showCommand{}).writeText(context.Background(), &buf, nil)
+	c.Assert(err, qt.ErrorMatches, `no macaroons`)
+}
+
+var describeConditionTests = []struct {
+	about  string
+	cond   string
+	loc    *time.Location
+	expect string
+}{{
+	about:  "not a time-before condition",
+	cond:   "declared user bob",
+	loc:    time.UTC,
+	expect: "declared user bob",
+}, {
+	about:  "invalid time",
+	cond:   "time-before tomorrow",
+	loc:    time.UTC,
+	expect: "time-before tomorrow",
+}, {
+	about:  "future time",
+	cond:   "time-before 2030-01-01T01:30:00Z",
+	loc:    time.UTC,
+	expect: "time-before 2030-01-01T01:30:00Z (expires 2030-01-01 01:30:00 UTC, in 1h30m0s)",
+}, {
+	about:  "past time",
+	cond:   "time-before 2029-12-31T23:59:50Z",
+	loc:    time.UTC,
+	expect: "time-before 2029-12-31T23:59:50Z (expired 2029-12-31 23:59:50 UTC, 10s ago)",
+}, {
+	about:  "time shown in the location of now",
+	cond:   "time-before 2030-01-01T01:00:00Z",
+	loc:    time.FixedZone("XYZ", 2*60*60),
+	expect: "time-before 2030-01-01T01:00:00Z (expires 2030-01-01 03:00:00 XYZ, in 1h0m0s)",
+}}
+
+func TestDescribeCondition(t *testing.T) {
+	c := qt.New(t)
+	ns := checkers.New(nil).Namespace()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range describeConditionTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(describeCondition(ns, test.cond, now.In(test.loc)), qt.Equals, test.expect)
+		})
+	}
+}
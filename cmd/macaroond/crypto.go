@@ -1,31 +1,215 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 
 	"github.com/rogpeppe/fastuuid"
 	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
 	"gopkg.in/errgo.v1"
 )
 
 var nonceGen = fastuuid.MustNewGenerator()
 
-func encrypt(data []byte, password string) []byte {
+// envelopeMagic prefixes password-encrypted data that
+// holds a versioned header. Data without this prefix
+// is in the original format, encrypted with an unsalted
+// SHA-256 hash of the password.
+const envelopeMagic = "macaroond-box"
+
+// envelopeVersion1 holds the envelope version that
+// uses scrypt to derive the key from the password.
+//
+// The version 1 envelope is laid out as follows:
+//
+//	envelopeMagic
+//	version [1]byte
+//	log2(N) [1]byte
+//	r [1]byte
+//	p [1]byte
+//	salt [saltLen]byte
+//	nonce [24]byte
+//	secretbox-encrypted data
+const envelopeVersion1 = 1
+
+const saltLen = 16
+
+// kdfParams holds the scrypt parameters used when encrypting
+// new data. The parameters used for existing data are read
+// from its header.
+var kdfParams = scryptParams{
+	logN: 15,
+	r:    8,
+	p:    1,
+}
+
+// Limits on the scrypt parameters that will be accepted from
+// an envelope header. The header is not authenticated until
+// after the key has been derived, so without these a corrupted
+// or malicious file could make key derivation take an arbitrary
+// amount of time or memory.
+const (
+	maxLogN      = 20
+	maxScryptMem = 1 << 30
+)
+
+type scryptParams struct {
+	logN uint8
+	r    uint8
+	p    uint8
+}
+
+// validate checks that the parameters are within the
+// bounds that we are prepared to use.
+func (p scryptParams) validate() error {
+	if p.logN == 0 || p.r == 0 || p.p == 0 {
+		return errgo.Newf("invalid scrypt parameters %+v", p)
+	}
+	if p.logN > maxLogN {
+		return errgo.Newf("scrypt parameter log2(N)=%d is too large", p.logN)
+	}
+	if uint64(p.r)*uint64(p.p) >= 1<<30 {
+		return errgo.Newf("scrypt parameters r=%d, p=%d are too large", p.r, p.p)
+	}
+	if 128*uint64(p.r)<<p.logN > maxScryptMem {
+		return errgo.Newf("scrypt parameters %+v need too much memory", p)
+	}
+	return nil
+}
+
+func (p scryptParams) key(password string, salt []byte) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<p.logN, int(p.r), int(p.p), 32)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot derive key from password")
+	}
+	return key, nil
+}
+
+// encrypt encrypts data with a key derived from the
+// given password using scrypt. The returned data
+// holds a header recording the scrypt parameters.
+func encrypt(data []byte, password string) ([]byte, error) {
+	salt, err := randomBytes(saltLen)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	params := kdfParams
+	key, err := params.key(password, salt)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(envelopeMagic)
+	buf.Write([]byte{envelopeVersion1, params.logN, params.r, params.p})
+	buf.Write(salt)
 	nonce := nonceGen.Next()
-	key := sha256.Sum256([]byte(password))
-	return secretbox.Seal(nonce[:], data, &nonce, &key)
+	buf.Write(nonce[:])
+	var boxKey [32]byte
+	copy(boxKey[:], key)
+	return secretbox.Seal(buf.Bytes(), data, &nonce, &boxKey), nil
 }
 
+// decrypt decrypts data that has been encrypted with encrypt.
+// It also decrypts data in the original unversioned format.
 func decrypt(data []byte, password string) ([]byte, error) {
-	if len(data) < 24 {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return decryptLegacy(data, password)
+	}
+	data = data[len(envelopeMagic):]
+	if len(data) < 1 {
 		return nil, errgo.Newf("encrypted data is too small")
 	}
-	key := sha256.Sum256([]byte(password))
+	if data[0] != envelopeVersion1 {
+		return nil, errgo.Newf("unknown encryption envelope version %d", data[0])
+	}
+	if len(data) < 4+saltLen+24 {
+		return nil, errgo.Newf("encrypted data is too small")
+	}
+	params := scryptParams{
+		logN: data[1],
+		r:    data[2],
+		p:    data[3],
+	}
+	data = data[4:]
+	key, err := params.key(password, data[:saltLen])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	data = data[saltLen:]
+	var boxKey [32]byte
+	copy(boxKey[:], key)
 	var nonce [24]byte
 	copy(nonce[:], data)
-	plain, ok := secretbox.Open(nil, data[len(nonce):], &nonce, &key)
+	plain, ok := secretbox.Open(nil, data[len(nonce):], &nonce, &boxKey)
 	if !ok {
 		return nil, errgo.Newf("bad password %q", password)
 	}
 	return plain, nil
 }
+
+// decryptLegacy decrypts data that was encrypted with
+// a key derived using a single SHA-256 hash of the password.
+func decryptLegacy(data []byte, password string) ([]byte, error) {
+	if len(data) < 24 {
+		return nil, errgo.Newf("encrypted data is too small")
+	}
+	plain, err := openWithKey(data, []byte(password))
+	if err != nil {
+		return nil, errgo.Newf("bad password %q", password)
+	}
+	return plain, nil
+}
+
+// sealWithKey encrypts data with a secretbox key derived from
+// the given key, which should hold high-entropy random data.
+func sealWithKey(data, key []byte) []byte {
+	nonce := nonceGen.Next()
+	boxKey := sha256.Sum256(key)
+	return secretbox.Seal(nonce[:], data, &nonce, &boxKey)
+}
+
+// openWithKey decrypts data that has been encrypted
+// with sealWithKey.
+func openWithKey(data, key []byte) ([]byte, error) {
+	if len(data) < 24 {
+		return nil, errgo.Newf("encrypted data is too small")
+	}
+	boxKey := sha256.Sum256(key)
+	var nonce [24]byte
+	copy(nonce[:], data)
+	plain, ok := secretbox.Open(nil, data[len(nonce):], &nonce, &boxKey)
+	if !ok {
+		return nil, errgo.Newf("cannot decrypt data")
+	}
+	return plain, nil
+}
+
+// openWithKeys decrypts data that has been encrypted
+// with sealWithKey using any of the given keys.
+func openWithKeys(data []byte, keys [][]byte) ([]byte, error) {
+	for _, key := range keys {
+		if plain, err := openWithKey(data, key); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, errgo.Newf("cannot decrypt data")
+}
+
+// resealWithKey re-encrypts data that has been encrypted with
+// sealWithKey using oldKey so that it is encrypted with newKey.
+// Data that is already encrypted with newKey is returned unchanged,
+// and the returned boolean is false.
+func resealWithKey(data, oldKey, newKey []byte) ([]byte, bool, error) {
+	if _, err := openWithKey(data, newKey); err == nil {
+		return data, false, nil
+	}
+	plain, err := openWithKey(data, oldKey)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return sealWithKey(plain, newKey), true, nil
+}
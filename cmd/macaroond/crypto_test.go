@@ -10,10 +10,37 @@ func TestEncryptDecrypt(t *testing.T) {
 	c := qt.New(t)
 	key := "hello"
 	data := []byte("some data")
-	boxed := encrypt(data, key)
+	boxed, err := encrypt(data, key)
+	c.Assert(err, qt.Equals, nil)
 	unboxed, err := decrypt(boxed, key)
 	c.Check(err, qt.Equals, nil)
 	c.Check(string(unboxed), qt.Equals, string(data))
+
+	_, err = decrypt(boxed, "other")
+	c.Check(err, qt.ErrorMatches, `bad password "other"`)
+}
+
+func TestDecryptUsesHeaderParams(t *testing.T) {
+	c := qt.New(t)
+	oldParams := kdfParams
+	defer func() {
+		kdfParams = oldParams
+	}()
+	kdfParams = scryptParams{
+		logN: 10,
+		r:    4,
+		p:    2,
+	}
+	data := []byte("some data")
+	boxed, err := encrypt(data, "hello")
+	c.Assert(err, qt.Equals, nil)
+
+	// Decryption uses the parameters in the header, not the
+	// current defaults.
+	kdfParams = oldParams
+	unboxed, err := decrypt(boxed, "hello")
+	c.Check(err, qt.Equals, nil)
+	c.Check(string(unboxed), qt.Equals, string(data))
 }
 
 func TestDecryptKnown(t *testing.T) {
@@ -27,3 +54,41 @@ func TestDecryptKnown(t *testing.T) {
 	c.Check(err, qt.Equals, nil)
 	c.Assert(len(unboxed), qt.Equals, 24)
 }
+
+func TestDecryptRejectsExpensiveParams(t *testing.T) {
+	c := qt.New(t)
+	boxed, err := encrypt([]byte("some data"), "hello")
+	c.Assert(err, qt.Equals, nil)
+	tests := []struct {
+		about       string
+		logN, r, p  byte
+		expectError string
+	}{{
+		about:       "zero r",
+		logN:        10,
+		r:           0,
+		p:           1,
+		expectError: `invalid scrypt parameters .*`,
+	}, {
+		about:       "logN too large",
+		logN:        31,
+		r:           8,
+		p:           1,
+		expectError: `scrypt parameter log2\(N\)=31 is too large`,
+	}, {
+		about:       "too much memory",
+		logN:        20,
+		r:           16,
+		p:           1,
+		expectError: `scrypt parameters .* need too much memory`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			data := append([]byte(nil), boxed...)
+			hdr := data[len(envelopeMagic)+1:]
+			hdr[0], hdr[1], hdr[2] = test.logN, test.r, test.p
+			_, err := decrypt(data, "hello")
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
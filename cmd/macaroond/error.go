@@ -32,6 +32,10 @@ func errorToResponse(ctx context.Context, err error) (int, interface{}) {
 		status = http.StatusBadRequest
 	case params.ErrUnauthorized:
 		status = http.StatusUnauthorized
+	case params.ErrLocked:
+		status = http.StatusLocked
+	case params.ErrVerificationFailed:
+		status = http.StatusForbidden
 	}
 	return status, errorBody
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"sync"
 	"time"
@@ -9,36 +8,96 @@ import (
 	"github.com/juju/httprequest"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 
+	"github.com/rogpeppe/macaroon-cmd/opcheck"
 	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
 )
 
-var rootKeyId = []byte("0")
-
-const expiryDuration = 24 * time.Hour
-
 type handler struct {
 	srv     *server
 	mu      sync.Mutex
 	rootKey []byte
 }
 
+// accessOp is the operation that allows access to the
+// entire API. It is granted by access macaroons unless
+// narrower operations are requested.
 var accessOp = bakery.Op{
 	Entity: "global",
 	Action: "access",
 }
 
+// endpointOps maps each operation that can be requested in
+// an access macaroon to its name in params.AccessRequest.Ops.
+var endpointOps = map[string]bakery.Op{
+	params.OpKeyRead: {
+		Entity: "key",
+		Action: "read",
+	},
+	params.OpKeyNew: {
+		Entity: "key",
+		Action: "new",
+	},
+	params.OpMacaroonCheck: {
+		Entity: "macaroon",
+		Action: "check",
+	},
+	params.OpLock: {
+		Entity: "server",
+		Action: "lock",
+	},
+	params.OpKeyPairRead: {
+		Entity: "keypair",
+		Action: "read",
+	},
+	params.OpKeyPairWrite: {
+		Entity: "keypair",
+		Action: "write",
+	},
+}
+
+// requiredOp returns the operation that must be allowed
+// by the access macaroon for the given request.
+func requiredOp(req interface{}) bakery.Op {
+	switch req.(type) {
+	case *params.FindRootKeyRequest:
+		return endpointOps[params.OpKeyRead]
+	case *params.NewRootKeyRequest, *params.MintMacaroonRequest, *params.StoreOpsRequest:
+		return endpointOps[params.OpKeyNew]
+	case *params.VerifyMacaroonRequest, *params.CheckMacaroonRequest, *params.FindOpsRequest:
+		return endpointOps[params.OpMacaroonCheck]
+	case *params.LockRequest:
+		return endpointOps[params.OpLock]
+	case *params.GetKeyPairRequest:
+		return endpointOps[params.OpKeyPairRead]
+	case *params.SetKeyPairRequest:
+		return endpointOps[params.OpKeyPairWrite]
+	}
+	return accessOp
+}
+
 func (srv *server) newHandler(p httprequest.Params, req interface{}) (*handler, context.Context, error) {
+	if !srv.peerPermitted(p.Context) {
+		return nil, nil, errgo.WithCausef(nil, params.ErrUnauthorized, "user not allowed to connect")
+	}
 	switch req.(type) {
 	case *params.AccessRequest,
-		*params.SetPasswordRequest:
-		// Both these requests check the password held in the request.
+		*params.SetPasswordRequest,
+		*params.UnlockRequest:
+		// These requests check the password held in the request.
 	default:
+		if _, ok := req.(*params.LockRequest); ok && srv.isLocked() {
+			// The access token cannot be checked while
+			// the server is locked, but there's nothing
+			// to do anyway, so allow the request.
+			break
+		}
 		// All other requests require the access token.
-		_, err := srv.bakery.Checker.Auth(httpbakery.RequestMacaroons(p.Request)...).Allow(p.Context, accessOp)
-		if err != nil {
-			return nil, nil, errgo.Mask(err)
+		if err := srv.checkAccess(p, requiredOp(req)); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Any)
 		}
 	}
 	return &handler{
@@ -46,35 +105,69 @@ func (srv *server) newHandler(p httprequest.Params, req interface{}) (*handler,
 	}, p.Context, nil
 }
 
+// checkAccess checks that the request holds a valid access token
+// that allows the given operation.
+func (srv *server) checkAccess(p httprequest.Params, op bakery.Op) error {
+	if srv.isLocked() {
+		// The access root keys are encrypted, so the token
+		// can't be checked until the server is unlocked.
+		return errgo.WithCausef(nil, params.ErrLocked, "locked - no password supplied yet")
+	}
+	b, err := srv.accessBakery()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	checker := b.Checker.Auth(httpbakery.RequestMacaroons(p.Request)...)
+	if _, err := checker.Allow(p.Context, op); err == nil || op == accessOp {
+		return errgo.Mask(err, errgo.Any)
+	}
+	// The token doesn't allow the specific operation,
+	// but it may allow access to everything.
+	if _, err := checker.Allow(p.Context, accessOp); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
 func (h *handler) SetPassword(req *params.SetPasswordRequest) error {
-	if err := h.srv.setPassword(req.OldPassword, req.NewPassword); err != nil {
-		return errgo.Mask(err)
+	if err := h.srv.setPassword(req.OldPassword, req.NewPassword, req.InvalidateTokens); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
 	}
 	return nil
 }
 
 func (h *handler) NewRootKey(p httprequest.Params, req *params.NewRootKeyRequest) (*params.NewRootKeyResponse, error) {
-	masterKey, err := h.srv.getMasterKey()
+	if err := checkExpiry(req.Expiry, h.srv.maxKeyLifetime); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	key, err := h.srv.rootKeys.newKey(req.Expiry)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked), errgo.Is(params.ErrBadRequest))
 	}
-	// TODO use master key to decrypt root key stored elsewhere.
 	return &params.NewRootKeyResponse{
-		Id:      rootKeyId,
-		RootKey: masterKey,
+		Id:      []byte(key.id),
+		RootKey: key.key,
 	}, nil
 }
 
 func (h *handler) FindRootKey(p httprequest.Params, req *params.FindRootKeyRequest) (*params.FindRootKeyResponse, error) {
-	if !bytes.Equal([]byte(req.Id), rootKeyId) {
-		return nil, params.ErrNotFound
+	if req.Id == legacyRootKeyId {
+		// Macaroons created before root keys were stored
+		// separately used the master key directly.
+		rootKey, err := h.srv.legacyRootKey()
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+		}
+		return &params.FindRootKeyResponse{
+			RootKey: rootKey,
+		}, nil
 	}
-	masterKey, err := h.srv.getMasterKey()
+	key, err := h.srv.rootKeys.findKey(req.Id)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrLocked))
 	}
 	return &params.FindRootKeyResponse{
-		RootKey: masterKey,
+		RootKey: key.key,
 	}, nil
 }
 
@@ -82,10 +175,25 @@ func (h *handler) Access(p httprequest.Params, req *params.AccessRequest) (*para
 	if h.srv.needsPassword() {
 		return nil, errgo.WithCausef(nil, params.ErrInitialPasswordNeeded, "")
 	}
-	if err := h.srv.checkPassword(req.Password); err != nil {
-		return nil, errgo.WithCausef(err, params.ErrUnauthorized, "")
+	ops, err := accessOps(req.Ops)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	lifetime := accessLifetime(req.LifetimeSeconds, h.srv.maxAccessLifetime)
+	// Processes running as an allowed user don't need a password,
+	// but the password is still needed to unlock the server.
+	if !h.srv.peerAllowed(p.Context) || h.srv.isLocked() {
+		if err := h.srv.checkPassword(req.Password); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrUnauthorized, "")
+		}
+	}
+	b, err := h.srv.accessBakery()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
 	}
-	m, err := h.srv.bakery.Oven.NewMacaroon(p.Context, httpbakery.RequestVersion(p.Request), time.Now().Add(expiryDuration), nil, accessOp)
+	expiry := time.Now().Add(lifetime)
+	ctx := contextWithExpiry(p.Context, expiry)
+	m, err := b.Oven.NewMacaroon(ctx, httpbakery.RequestVersion(p.Request), expiry, nil, ops...)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot make macaroon")
 	}
@@ -93,3 +201,236 @@ func (h *handler) Access(p httprequest.Params, req *params.AccessRequest) (*para
 		Macaroon: m,
 	}, nil
 }
+
+// accessLifetime returns the lifetime of an access macaroon that's
+// been requested with the given lifetime in seconds. The lifetime
+// is never more than max.
+func accessLifetime(seconds int64, max time.Duration) time.Duration {
+	if seconds <= 0 || seconds > int64(max/time.Second) {
+		return max
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// accessOps returns the operations that should be
+// allowed by an access macaroon that's been requested
+// with the given operation names.
+func accessOps(names []string) ([]bakery.Op, error) {
+	if len(names) == 0 {
+		return []bakery.Op{accessOp}, nil
+	}
+	ops := make([]bakery.Op, len(names))
+	for i, name := range names {
+		if name == params.OpAccess {
+			ops[i] = accessOp
+			continue
+		}
+		op, ok := endpointOps[name]
+		if !ok {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unknown operation %q", name)
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
+
+// Lock locks the server, so that the password must be
+// provided again before any root keys can be used.
+func (h *handler) Lock(req *params.LockRequest) error {
+	h.srv.lock()
+	return nil
+}
+
+// Unlock unlocks the server by decrypting the master key
+// with the given password.
+func (h *handler) Unlock(req *params.UnlockRequest) error {
+	if h.srv.needsPassword() {
+		return errgo.WithCausef(nil, params.ErrInitialPasswordNeeded, "")
+	}
+	if err := h.srv.checkPassword(req.Password); err != nil {
+		return errgo.WithCausef(err, params.ErrUnauthorized, "")
+	}
+	return nil
+}
+
+// StoreOps stores a set of operations for use in macaroon ids.
+// The key must be the one that bakery.Oven derives from the
+// operations, so that clients cannot store operations under
+// a key that refers to a different set of operations.
+func (h *handler) StoreOps(p httprequest.Params, req *params.StoreOpsRequest) error {
+	if len(req.Body.Ops) == 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no operations specified")
+	}
+	ops := bakery.CanonicalOps(req.Body.Ops)
+	if req.Body.Key != multiOpEntity(ops) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "key %q does not match operations", req.Body.Key)
+	}
+	if err := checkExpiry(req.Body.Expiry, h.srv.maxKeyLifetime); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := h.srv.ops.PutOps(p.Context, req.Body.Key, ops, req.Body.Expiry); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// FindOps returns the operations stored with the given key.
+func (h *handler) FindOps(p httprequest.Params, req *params.FindOpsRequest) (*params.FindOpsResponse, error) {
+	ops, err := h.srv.ops.GetOps(p.Context, req.Key)
+	if errgo.Cause(err) == bakery.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "operations not found")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &params.FindOpsResponse{
+		Ops: ops,
+	}, nil
+}
+
+// GetKeyPair returns the stored key pair, creating it if necessary.
+func (h *handler) GetKeyPair(req *params.GetKeyPairRequest) (*params.GetKeyPairResponse, error) {
+	key, err := h.srv.keyPair()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return &params.GetKeyPairResponse{
+		KeyPair: key,
+	}, nil
+}
+
+// SetKeyPair replaces the stored key pair.
+func (h *handler) SetKeyPair(req *params.SetKeyPairRequest) error {
+	if req.Body.KeyPair == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no key pair provided")
+	}
+	if err := h.srv.setKeyPair(req.Body.KeyPair); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return nil
+}
+
+// MintMacaroon creates a new macaroon associated with the given
+// operations. The root key never leaves the server.
+func (h *handler) MintMacaroon(p httprequest.Params, req *params.MintMacaroonRequest) (*params.MintMacaroonResponse, error) {
+	if len(req.Body.Ops) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no operations specified")
+	}
+	if req.Body.Version > bakery.LatestVersion {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unknown bakery version %d", req.Body.Version)
+	}
+	for _, cav := range req.Body.Caveats {
+		// Adding a third party caveat would mean contacting
+		// its location, which we don't want clients to be
+		// able to make the server do.
+		if cav.Location != "" {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "third party caveat %q not allowed", cav.Condition)
+		}
+	}
+	if err := checkExpiry(req.Body.Expiry, h.srv.maxKeyLifetime); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	oven, err := h.srv.clientOven()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	if ns := req.Body.Namespace; ns != nil {
+		// The oven adds standard caveats such as
+		// the expiry time, so make sure they can be
+		// resolved.
+		ns.Register(checkers.StdNamespace, "")
+		oven = h.srv.newOven(oven.Key(), ns)
+	}
+	ctx := contextWithExpiry(p.Context, req.Body.Expiry)
+	m, err := oven.NewMacaroon(ctx, req.Body.Version, req.Body.Expiry, req.Body.Caveats, req.Body.Ops...)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make macaroon")
+	}
+	return &params.MintMacaroonResponse{
+		Macaroon: m,
+	}, nil
+}
+
+// VerifyMacaroon verifies the signature of a macaroon and
+// returns its operations and first party caveat conditions.
+// It does not check the conditions.
+func (h *handler) VerifyMacaroon(p httprequest.Params, req *params.VerifyMacaroonRequest) (*params.VerifyMacaroonResponse, error) {
+	if len(req.Body.Macaroons) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no macaroons provided")
+	}
+	oven, err := h.srv.clientOven()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	ops, conditions, err := oven.MacaroonOps(p.Context, req.Body.Macaroons)
+	if err != nil {
+		if _, ok := errgo.Cause(err).(*bakery.VerificationError); ok {
+			return nil, errgo.WithCausef(err, params.ErrVerificationFailed, "")
+		}
+		return nil, errgo.Notef(err, "cannot verify macaroon")
+	}
+	return &params.VerifyMacaroonResponse{
+		Ops:        ops,
+		Conditions: conditions,
+	}, nil
+}
+
+// CheckMacaroon checks whether the given macaroons allow
+// the given operations. Any first party caveats that aren't
+// recognized by the server are returned to the client
+// to be checked.
+func (h *handler) CheckMacaroon(p httprequest.Params, req *params.CheckMacaroonRequest) (*params.CheckMacaroonResponse, error) {
+	if len(req.Body.Ops) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no operations specified")
+	}
+	pol, err := policy.New(req.Body.Policy)
+	if err != nil {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid policy: %v", err)
+	}
+	ctx := params.ContextWithCheckContext(p.Context, req.Body.Context)
+	if !req.Body.Any {
+		resp, err := h.checkOps(ctx, &req.Body, pol, req.Body.Ops)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrVerificationFailed), errgo.Is(params.ErrLocked))
+		}
+		return resp, nil
+	}
+	statuses, err := h.checkEachOp(ctx, &req.Body, pol)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return &params.CheckMacaroonResponse{
+		Ops: statuses,
+	}, nil
+}
+
+// checkOps checks whether the macaroons in the request allow
+// all the given operations, checking the conditions named by
+// the given policy against it. If they don't, it returns an error
+// with a params.ErrVerificationFailed cause.
+func (h *handler) checkOps(ctx context.Context, req *params.CheckMacaroonRequestBody, pol *policy.Policy, ops []bakery.Op) (*params.CheckMacaroonResponse, error) {
+	oven, err := h.srv.clientOven()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	resp, err := opcheck.CheckOps(ctx, oven, req.Macaroons, ops, req.Namespace, pol)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrVerificationFailed))
+	}
+	return resp, nil
+}
+
+// checkEachOp checks each of the operations in the request
+// separately, returning the status of each one. The conditions
+// in the macaroons are checked only once.
+func (h *handler) checkEachOp(ctx context.Context, req *params.CheckMacaroonRequestBody, pol *policy.Policy) ([]params.OpStatus, error) {
+	oven, err := h.srv.clientOven()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	statuses, err := opcheck.CheckEachOp(ctx, oven, req.Macaroons, req.Ops, req.Namespace, pol)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return statuses, nil
+}
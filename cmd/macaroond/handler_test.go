@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/httprequest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
+)
+
+var accessLifetimeTests = []struct {
+	about   string
+	seconds int64
+	expect  time.Duration
+}{{
+	about:  "zero lifetime",
+	expect: time.Hour,
+}, {
+	about:   "negative lifetime",
+	seconds: -1,
+	expect:  time.Hour,
+}, {
+	about:   "lifetime within maximum",
+	seconds: 60,
+	expect:  time.Minute,
+}, {
+	about:   "maximum lifetime",
+	seconds: 3600,
+	expect:  time.Hour,
+}, {
+	about:   "lifetime beyond maximum",
+	seconds: 3601,
+	expect:  time.Hour,
+}, {
+	about:   "lifetime that would overflow",
+	seconds: 1 << 62,
+	expect:  time.Hour,
+}}
+
+func TestAccessLifetime(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range accessLifetimeTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(accessLifetime(test.seconds, time.Hour), qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestAccess(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	srv.maxAccessLifetime = time.Hour
+	err = srv.setPassword("", "pw", false)
+	c.Assert(err, qt.Equals, nil)
+
+	h := &handler{
+		srv: srv,
+	}
+	p := httprequest.Params{
+		Request: httptest.NewRequest("POST", "/macaroon", nil),
+		Context: context.Background(),
+	}
+	for _, test := range accessLifetimeTests {
+		c.Run(test.about, func(c *qt.C) {
+			resp, err := h.Access(p, &params.AccessRequest{
+				Password:        "pw",
+				LifetimeSeconds: test.seconds,
+			})
+			c.Assert(err, qt.Equals, nil)
+			expiry, ok := checkers.ExpiryTime(nil, resp.Macaroon.M().Caveats())
+			c.Assert(ok, qt.Equals, true)
+			lifetime := time.Until(expiry)
+			c.Assert(lifetime <= test.expect, qt.Equals, true, qt.Commentf("lifetime %v", lifetime))
+			c.Assert(lifetime > test.expect-time.Minute, qt.Equals, true, qt.Commentf("lifetime %v", lifetime))
+		})
+	}
+
+	_, err = h.Access(p, &params.AccessRequest{
+		Password: "wrong",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+}
+
+func TestAccessOps(t *testing.T) {
+	c := qt.New(t)
+	ops, err := accessOps(nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ops, qt.DeepEquals, []bakery.Op{accessOp})
+
+	ops, err = accessOps([]string{params.OpKeyRead, params.OpAccess, params.OpLock, params.OpMacaroonCheck})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ops, qt.DeepEquals, []bakery.Op{
+		endpointOps[params.OpKeyRead],
+		accessOp,
+		endpointOps[params.OpLock],
+		endpointOps[params.OpMacaroonCheck],
+	})
+
+	_, err = accessOps([]string{params.OpKeyRead, "foo"})
+	c.Assert(err, qt.ErrorMatches, `unknown operation "foo"`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
+
+func TestRequiredOp(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		req    interface{}
+		expect bakery.Op
+	}{
+		{&params.FindRootKeyRequest{}, endpointOps[params.OpKeyRead]},
+		{&params.NewRootKeyRequest{}, endpointOps[params.OpKeyNew]},
+		{&params.MintMacaroonRequest{}, endpointOps[params.OpKeyNew]},
+		{&params.StoreOpsRequest{}, endpointOps[params.OpKeyNew]},
+		{&params.VerifyMacaroonRequest{}, endpointOps[params.OpMacaroonCheck]},
+		{&params.CheckMacaroonRequest{}, endpointOps[params.OpMacaroonCheck]},
+		{&params.FindOpsRequest{}, endpointOps[params.OpMacaroonCheck]},
+		{&params.LockRequest{}, endpointOps[params.OpLock]},
+		{&params.GetKeyPairRequest{}, endpointOps[params.OpKeyPairRead]},
+		{&params.SetKeyPairRequest{}, endpointOps[params.OpKeyPairWrite]},
+		{&params.UnlockRequest{}, accessOp},
+	}
+	for _, test := range tests {
+		c.Assert(requiredOp(test.req), qt.Equals, test.expect, qt.Commentf("%T", test.req))
+	}
+}
+
+func TestMintMacaroonRejectsThirdPartyCaveats(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.setPassword("", "pw", false)
+	c.Assert(err, qt.Equals, nil)
+
+	h := &handler{
+		srv: srv,
+	}
+	p := httprequest.Params{
+		Request: httptest.NewRequest("POST", "/macaroon/new", nil),
+		Context: context.Background(),
+	}
+	req := &params.MintMacaroonRequest{
+		Body: params.MintMacaroonRequestBody{
+			Version: bakery.LatestVersion,
+			Expiry:  time.Now().Add(time.Hour),
+			Caveats: []checkers.Caveat{{
+				Condition: "is-authenticated-user",
+				Location:  "https://example.com",
+			}},
+			Ops: []bakery.Op{{
+				Entity: "foo",
+				Action: "read",
+			}},
+		},
+	}
+	_, err = h.MintMacaroon(p, req)
+	c.Assert(err, qt.ErrorMatches, `third party caveat "is-authenticated-user" not allowed`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	// First party caveats are fine.
+	req.Body.Caveats = []checkers.Caveat{checkers.DeclaredCaveat("user", "bob")}
+	resp, err := h.MintMacaroon(p, req)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.Macaroon.M().Caveats(), qt.HasLen, 2)
+}
+
+func TestStoreOps(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	h := &handler{
+		srv: srv,
+	}
+	p := httprequest.Params{
+		Request: httptest.NewRequest("PUT", "/ops", nil),
+		Context: context.Background(),
+	}
+	ops := []bakery.Op{{
+		Entity: "b",
+		Action: "write",
+	}, {
+		Entity: "a",
+		Action: "read",
+	}, {
+		Entity: "a",
+		Action: "read",
+	}}
+	key := multiOpEntity(bakery.CanonicalOps(ops))
+
+	err = h.StoreOps(p, &params.StoreOpsRequest{
+		Body: params.StoreOpsRequestBody{
+			Key: "multi-foo",
+			Ops: ops,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `key "multi-foo" does not match operations`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = h.StoreOps(p, &params.StoreOpsRequest{
+		Body: params.StoreOpsRequestBody{
+			Key: key,
+			Ops: ops[:1],
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	srv.maxKeyLifetime = time.Hour
+	err = h.StoreOps(p, &params.StoreOpsRequest{
+		Body: params.StoreOpsRequestBody{
+			Key:    key,
+			Ops:    ops,
+			Expiry: time.Now().Add(2 * time.Hour),
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `expiry time .* is more than 1h0m0s in the future`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = h.StoreOps(p, &params.StoreOpsRequest{
+		Body: params.StoreOpsRequestBody{
+			Key: key,
+			Ops: ops,
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	gotOps, err := srv.ops.GetOps(p.Context, key)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gotOps, qt.DeepEquals, []bakery.Op{ops[1], ops[0]})
+}
+
+func TestCheckMacaroonPolicy(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.setPassword("", "pw", false)
+	c.Assert(err, qt.Equals, nil)
+
+	h := &handler{
+		srv: srv,
+	}
+	p := httprequest.Params{
+		Request: httptest.NewRequest("POST", "/macaroon/check", nil),
+		Context: context.Background(),
+	}
+	op := bakery.Op{
+		Entity: "foo",
+		Action: "read",
+	}
+	resp, err := h.MintMacaroon(p, &params.MintMacaroonRequest{
+		Body: params.MintMacaroonRequestBody{
+			Version: bakery.LatestVersion,
+			Expiry:  time.Now().Add(time.Hour),
+			Caveats: []checkers.Caveat{{
+				Condition: "env dev",
+			}},
+			Ops: []bakery.Op{op},
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	check := func(rules []policy.Rule) (*params.CheckMacaroonResponse, error) {
+		return h.CheckMacaroon(p, &params.CheckMacaroonRequest{
+			Body: params.CheckMacaroonRequestBody{
+				Macaroons: []macaroon.Slice{{resp.Macaroon.M()}},
+				Ops:       []bakery.Op{op},
+				Policy:    rules,
+			},
+		})
+	}
+
+	// Without a policy, the condition is unknown.
+	checkResp, err := check(nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(checkResp.UnknownConditions, qt.DeepEquals, []string{"env dev"})
+
+	// The policy is used to check the condition.
+	checkResp, err = check([]policy.Rule{{
+		Condition: "env",
+		Values:    []string{"dev", "prod"},
+	}})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(checkResp.UnknownConditions, qt.HasLen, 0)
+
+	_, err = check([]policy.Rule{{
+		Condition: "env",
+		Values:    []string{"prod"},
+	}})
+	c.Assert(err, qt.ErrorMatches, `caveat "env dev" not allowed by policy`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrVerificationFailed)
+
+	_, err = check([]policy.Rule{{
+		Condition: "env",
+	}})
+	c.Assert(err, qt.ErrorMatches, `invalid policy: invalid rule 0: .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
+
+func TestCheckMacaroonAny(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.setPassword("", "pw", false)
+	c.Assert(err, qt.Equals, nil)
+
+	h := &handler{
+		srv: srv,
+	}
+	p := httprequest.Params{
+		Request: httptest.NewRequest("POST", "/macaroon/check", nil),
+		Context: context.Background(),
+	}
+	op := func(action string) bakery.Op {
+		return bakery.Op{
+			Entity: "foo",
+			Action: action,
+		}
+	}
+	mint := func(cond string, ops ...bakery.Op) macaroon.Slice {
+		resp, err := h.MintMacaroon(p, &params.MintMacaroonRequest{
+			Body: params.MintMacaroonRequestBody{
+				Version: bakery.LatestVersion,
+				Expiry:  time.Now().Add(time.Hour),
+				Caveats: []checkers.Caveat{{
+					Condition: cond,
+				}},
+				Ops: ops,
+			},
+		})
+		c.Assert(err, qt.Equals, nil)
+		return macaroon.Slice{resp.Macaroon.M()}
+	}
+	mss := []macaroon.Slice{
+		mint("env dev", op("read")),
+		mint("env prod", op("write")),
+		mint("other x", op("list"), op("delete")),
+	}
+	resp, err := h.CheckMacaroon(p, &params.CheckMacaroonRequest{
+		Body: params.CheckMacaroonRequestBody{
+			Macaroons: mss,
+			Ops:       []bakery.Op{op("read"), op("write"), op("list"), op("delete")},
+			Policy: []policy.Rule{{
+				Condition: "env",
+				Values:    []string{"dev"},
+			}},
+			Any: true,
+		},
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.Ops, qt.HasLen, 4)
+	for i, action := range []string{"read", "write", "list", "delete"} {
+		c.Assert(resp.Ops[i].Op, qt.Equals, op(action))
+	}
+	c.Assert(resp.Ops[0].Allowed, qt.Equals, true)
+	c.Assert(resp.Ops[0].UnknownConditions, qt.HasLen, 0)
+	c.Assert(resp.Ops[1].Allowed, qt.Equals, false)
+	c.Assert(resp.Ops[1].Error, qt.Equals, `caveat "env prod" not allowed by policy`)
+	// Each operation only reports the conditions of
+	// the macaroon that allowed it.
+	for _, status := range resp.Ops[2:] {
+		c.Assert(status.Allowed, qt.Equals, true)
+		c.Assert(status.Conditions, qt.HasLen, 2)
+		c.Assert(status.UnknownConditions, qt.DeepEquals, []string{"other x"})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+// storedKeyPair holds the on-disk representation of a key pair.
+// The private key is encrypted with the master key.
+type storedKeyPair struct {
+	Public              bakery.PublicKey `json:"public"`
+	EncryptedPrivateKey []byte           `json:"encryptedPrivateKey"`
+}
+
+// keyPair returns the stored key pair used by clients,
+// creating a new one if none has been stored yet.
+func (srv *server) keyPair() (*bakery.KeyPair, error) {
+	key, err := srv.storedKeyPair(keyPairFile, bakery.GenerateKey)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return key, nil
+}
+
+// setKeyPair replaces the stored key pair used by clients.
+func (srv *server) setKeyPair(key *bakery.KeyPair) error {
+	srv.keyPairMu.Lock()
+	defer srv.keyPairMu.Unlock()
+	masterKeys, err := srv.getMasterKeys()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return srv.writeKeyPair(keyPairFile, key, masterKeys[0])
+}
+
+// bakeryKey returns the key pair used by the server's own
+// bakeries, creating it if needed. Unlike the key pair
+// returned by keyPair, it is never given to clients.
+func (srv *server) bakeryKey() (*bakery.KeyPair, error) {
+	key, err := srv.storedKeyPair(bakeryKeyFile, srv.newBakeryKey)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	// The key is now stored encrypted, so don't
+	// leave an unencrypted copy around.
+	if err := srv.store.remove(legacyBakeryKeyFile); err != nil {
+		return nil, errgo.Notef(err, "cannot remove legacy bakery key")
+	}
+	return key, nil
+}
+
+// newBakeryKey returns the bakery key to store when there is
+// none. The unencrypted key used by earlier versions of the
+// server is used if there is one, so that it keeps the same
+// public key.
+func (srv *server) newBakeryKey() (*bakery.KeyPair, error) {
+	var key bakery.KeyPair
+	err := srv.store.readJSON(legacyBakeryKeyFile, &key)
+	if err == nil {
+		return &key, nil
+	}
+	if !os.IsNotExist(errgo.Cause(err)) {
+		return nil, errgo.Notef(err, "cannot read legacy bakery key")
+	}
+	return bakery.GenerateKey()
+}
+
+// storedKeyPair returns the key pair stored in the file with
+// the given name. If there is none, it stores and returns
+// the key pair returned by newKey.
+func (srv *server) storedKeyPair(name string, newKey func() (*bakery.KeyPair, error)) (*bakery.KeyPair, error) {
+	srv.keyPairMu.Lock()
+	defer srv.keyPairMu.Unlock()
+	masterKeys, err := srv.getMasterKeys()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	var stored storedKeyPair
+	err = srv.store.readJSON(name, &stored)
+	if err == nil {
+		privateKey, err := openWithKeys(stored.EncryptedPrivateKey, masterKeys)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decrypt key pair")
+		}
+		key := &bakery.KeyPair{
+			Public: stored.Public,
+		}
+		if len(privateKey) != len(key.Private.Key) {
+			return nil, errgo.Newf("stored private key has invalid length")
+		}
+		copy(key.Private.Key[:], privateKey)
+		return key, nil
+	}
+	if !os.IsNotExist(errgo.Cause(err)) {
+		return nil, errgo.Notef(err, "cannot read key pair")
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := srv.writeKeyPair(name, key, masterKeys[0]); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// rekeyKeyPair re-encrypts the key pair stored in the file
+// with the given name, if it is encrypted with oldMasterKey,
+// so that it is encrypted with masterKey.
+func (srv *server) rekeyKeyPair(name string, oldMasterKey, masterKey []byte) error {
+	srv.keyPairMu.Lock()
+	defer srv.keyPairMu.Unlock()
+	var stored storedKeyPair
+	if err := srv.store.readJSON(name, &stored); err != nil {
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	encryptedKey, changed, err := resealWithKey(stored.EncryptedPrivateKey, oldMasterKey, masterKey)
+	if err != nil || !changed {
+		return errgo.Mask(err)
+	}
+	stored.EncryptedPrivateKey = encryptedKey
+	return errgo.Mask(srv.store.writeJSON(name, stored))
+}
+
+// writeKeyPair writes the given key pair to the file with the
+// given name, encrypted with the master key.
+// Called with srv.keyPairMu held.
+func (srv *server) writeKeyPair(name string, key *bakery.KeyPair, masterKey []byte) error {
+	if err := srv.store.writeJSON(name, storedKeyPair{
+		Public:              key.Public,
+		EncryptedPrivateKey: sealWithKey(key.Private.Key[:], masterKey),
+	}); err != nil {
+		return errgo.Notef(err, "cannot write key pair")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+func TestKeyPair(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+
+	srv := &server{
+		store:     st,
+		masterKey: []byte("012345678901234567890123"),
+	}
+	// A key pair is created when there is none.
+	key1, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	key2, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*key2, qt.Equals, *key1)
+
+	newKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	err = srv.setKeyPair(newKey)
+	c.Assert(err, qt.Equals, nil)
+	key3, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*key3, qt.Equals, *newKey)
+
+	// The key pair can't be retrieved when the server is locked.
+	srv.masterKey = nil
+	_, err = srv.keyPair()
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrLocked)
+}
+
+func TestBakeryKey(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.setPassword("", "pw", false)
+	c.Assert(err, qt.Equals, nil)
+	// The bakeries use their own key, not the
+	// key pair that is given to clients.
+	oven, err := srv.clientOven()
+	c.Assert(err, qt.Equals, nil)
+	bakeryKey := *oven.Key()
+	keyPair, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*keyPair, qt.Not(qt.Equals), bakeryKey)
+
+	// Replacing the key pair doesn't change the bakery key.
+	newKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	err = srv.setKeyPair(newKey)
+	c.Assert(err, qt.Equals, nil)
+	oven, err = srv.clientOven()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*oven.Key(), qt.Equals, bakeryKey)
+
+	// The bakery key is stored encrypted and is
+	// forgotten when the server is locked.
+	var stored storedKeyPair
+	err = srv.store.readJSON(bakeryKeyFile, &stored)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(stored.Public, qt.Equals, bakeryKey.Public)
+	c.Assert(bytes.Contains(stored.EncryptedPrivateKey, bakeryKey.Private.Key[:]), qt.Equals, false)
+	srv.lock()
+	_, err = srv.clientOven()
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrLocked)
+
+	// The same key is used when the server is unlocked again.
+	err = srv.checkPassword("pw")
+	c.Assert(err, qt.Equals, nil)
+	b, err := srv.accessBakery()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*b.Oven.Key(), qt.Equals, bakeryKey)
+}
+
+func TestBakeryKeyUsesLegacyBakeryKey(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+
+	legacyKey, err := bakery.GenerateKey()
+	c.Assert(err, qt.Equals, nil)
+	err = st.writeJSON(legacyBakeryKeyFile, legacyKey)
+	c.Assert(err, qt.Equals, nil)
+
+	srv := &server{
+		store:     st,
+		masterKey: []byte("012345678901234567890123"),
+	}
+	oven, err := srv.clientOven()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*oven.Key(), qt.Equals, *legacyKey)
+
+	// The unencrypted copy has been removed.
+	_, err = st.readFile(legacyBakeryKeyFile)
+	c.Assert(os.IsNotExist(errgo.Cause(err)), qt.Equals, true)
+
+	// The legacy key is not given to clients.
+	key, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*key, qt.Not(qt.Equals), *legacyKey)
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// lockDir opens the lock file at the given path and acquires
+// an exclusive lock on it. The lock is released when the
+// returned file is closed.
+func lockDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errgo.Newf("directory is in use by another macaroond process")
+		}
+		return nil, errgo.Mask(err)
+	}
+	return f, nil
+}
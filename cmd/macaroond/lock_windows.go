@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+var (
+	modkernel32    = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = modkernel32.NewProc("LockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockDir opens the lock file at the given path and acquires
+// an exclusive lock on it. The lock is released when the
+// returned file is closed.
+func lockDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Lock the first byte of the file, which is enough to
+	// exclude other processes that lock the same way.
+	var overlapped syscall.Overlapped
+	r1, _, err := procLockFileEx.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if r1 == 0 {
+		f.Close()
+		if err == errorLockViolation {
+			return nil, errgo.Newf("directory is in use by another macaroond process")
+		}
+		return nil, errgo.Mask(err)
+	}
+	return f, nil
+}
@@ -2,16 +2,25 @@ package macaroondclient
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/juju/httprequest"
 	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
 
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 	"gopkg.in/macaroon.v2-unstable"
 )
@@ -20,33 +29,171 @@ import (
 
 type Client struct {
 	client
+	discharger Discharger
+
+	mu sync.Mutex
+	// token holds the access token, which may
+	// not have been discharged yet.
+	token bakery.Slice
+	// accessToken holds the encoded form of the token
+	// bound to its discharges, or the empty string
+	// if the token has not been discharged yet.
 	accessToken string
+	// tokenGen is incremented every time the token changes,
+	// so that a discharged token is not recorded if the
+	// token has been replaced while it was being discharged.
+	tokenGen int
+}
+
+// Discharger is used to acquire discharge macaroons for
+// third party caveats in an access token. It is implemented
+// by *httpbakery.Client.
+type Discharger interface {
+	AcquireDischarge(ctx context.Context, cav macaroon.Caveat, payload []byte) (*bakery.Macaroon, error)
+}
+
+// Params holds the parameters for connecting to
+// a macaroond server.
+type Params struct {
+	// Network holds the network to connect with. It may
+	// be "unix", "tcp" or "tls". The "tls" network uses
+	// HTTPS over TCP.
+	Network string
+
+	// Addr holds the address or socket path to connect to.
+	Addr string
+
+	// CACert holds the path to a PEM file holding certificates
+	// to trust when connecting to a TLS server. If it is empty,
+	// the system's root certificates are used.
+	CACert string
+
+	// ClientCert and ClientKey hold paths to PEM files holding
+	// the certificate and key to present to a TLS server.
+	// They are only needed when the server requires
+	// client certificates.
+	ClientCert string
+	ClientKey  string
+
+	// Discharger is used to discharge any third party caveats
+	// that have been added to the access token. If it is nil,
+	// an httpbakery client that opens a web browser for
+	// interaction is used. Discharger is not recorded in
+	// the location.
+	Discharger Discharger
+}
+
+// Location returns the parameters encoded as a macaroon
+// location, suitable for parsing with ParseLocation.
+// The location holds the network and address separated
+// by a space, followed by any TLS options in URL query form.
+func (p Params) Location() string {
+	loc := p.Network + " " + p.Addr
+	v := make(url.Values)
+	if p.CACert != "" {
+		v.Set("ca", p.CACert)
+	}
+	if p.ClientCert != "" {
+		v.Set("cert", p.ClientCert)
+	}
+	if p.ClientKey != "" {
+		v.Set("key", p.ClientKey)
+	}
+	if len(v) > 0 {
+		loc += " " + v.Encode()
+	}
+	return loc
+}
+
+// ParseLocation parses a location as returned by Params.Location.
+func ParseLocation(loc string) (Params, error) {
+	parts := strings.SplitN(loc, " ", 3)
+	if len(parts) < 2 {
+		return Params{}, errgo.Newf("location %q in incorrect format", loc)
+	}
+	p := Params{
+		Network: parts[0],
+		Addr:    parts[1],
+	}
+	if len(parts) == 3 {
+		v, err := url.ParseQuery(parts[2])
+		if err != nil {
+			return Params{}, errgo.Notef(err, "invalid options in location %q", loc)
+		}
+		p.CACert = v.Get("ca")
+		p.ClientCert = v.Get("cert")
+		p.ClientKey = v.Get("key")
+	}
+	return p, nil
 }
 
 // New returns a new client that uses the given token for
 // access. If accessToken is nil, the only methods
 // that may be called are Login and ChangePassword.
-func New(netw, addr string, accessToken macaroon.Slice) *Client {
+//
+// Any third party caveats in the access token that aren't
+// discharged by the other macaroons in the slice are discharged
+// using p.Discharger before the token is first used.
+func New(p Params, accessToken bakery.Slice) (*Client, error) {
 	var c Client
-	if netw == "tcp" {
-		c.Client.BaseURL = "http://" + addr
-	} else {
+	c.discharger = p.Discharger
+	if c.discharger == nil {
+		bclient := httpbakery.NewClient()
+		bclient.AddInteractor(httpbakery.WebBrowserInteractor{})
+		c.discharger = bclient
+	}
+	transport := &http.Transport{}
+	switch p.Network {
+	case "tls":
+		tlsConfig, err := p.tlsConfig()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		c.Client.BaseURL = "https://" + p.Addr
+		transport.TLSClientConfig = tlsConfig
+	case "tcp":
+		c.Client.BaseURL = "http://" + p.Addr
+	default:
 		// For decent errors only - address is ignored.
 		c.Client.BaseURL = "http://localsocket"
+		transport.Dial = func(_, _ string) (net.Conn, error) {
+			return net.Dial(p.Network, p.Addr)
+		}
 	}
 	c.Client.UnmarshalError = httprequest.ErrorUnmarshaler(new(params.Error))
 	c.Client.Doer = &clientDoer{
 		c: &c,
 		httpClient: &http.Client{
-			Transport: &http.Transport{
-				Dial: func(_, _ string) (net.Conn, error) {
-					return net.Dial(netw, addr)
-				},
-			},
+			Transport: transport,
 		},
 	}
 	c.setAccessToken(accessToken)
-	return &c
+	return &c, nil
+}
+
+// tlsConfig returns the TLS configuration to use
+// when connecting to the server.
+func (p Params) tlsConfig() (*tls.Config, error) {
+	var config tls.Config
+	if p.CACert != "" {
+		data, err := ioutil.ReadFile(p.CACert)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read CA certificate")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errgo.Newf("no certificates found in %q", p.CACert)
+		}
+		config.RootCAs = pool
+	}
+	if p.ClientCert != "" || p.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(p.ClientCert, p.ClientKey)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &config, nil
 }
 
 // Get implemets bakery.RootKeyStore.Get by getting the key from
@@ -61,29 +208,181 @@ func (c *Client) Get(ctx context.Context, id []byte) ([]byte, error) {
 	if errgo.Cause(err) == params.ErrNotFound {
 		return nil, bakery.ErrNotFound
 	}
-	return nil, errgo.Mask(err)
+	return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
 }
 
 // RootKey implements bakery.RootKeyStore.Get by using the
-// macaroond server.
+// macaroond server. The root key lasts for the server's
+// default root key lifetime.
 func (c *Client) RootKey(ctx context.Context) (rootKey, id []byte, err error) {
 	resp, err := c.NewRootKey(ctx, &params.NewRootKeyRequest{})
 	if err != nil {
-		return nil, nil, errgo.Mask(err)
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
 	}
 	return resp.RootKey, resp.Id, nil
 }
 
-func (c *Client) setAccessToken(ms macaroon.Slice) {
-	var tokenData string
-	if len(ms) > 0 {
-		tokenData0, err := json.Marshal(ms)
-		if err != nil {
-			panic(err)
+// PutOps implements bakery.MultiOpStore.PutOps by
+// storing the operations in the macaroond server.
+func (c *Client) PutOps(ctx context.Context, key string, ops []bakery.Op, expiry time.Time) error {
+	if err := c.StoreOps(ctx, &params.StoreOpsRequest{
+		Body: params.StoreOpsRequestBody{
+			Key:    key,
+			Ops:    ops,
+			Expiry: expiry,
+		},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return nil
+}
+
+// GetOps implements bakery.MultiOpStore.GetOps by
+// retrieving the operations from the macaroond server.
+func (c *Client) GetOps(ctx context.Context, key string) ([]bakery.Op, error) {
+	resp, err := c.FindOps(ctx, &params.FindOpsRequest{
+		Key: key,
+	})
+	if err == nil {
+		return resp.Ops, nil
+	}
+	if errgo.Cause(err) == params.ErrNotFound {
+		return nil, bakery.ErrNotFound
+	}
+	return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+}
+
+// NewMacaroon creates a new macaroon on the macaroond server.
+// The signature is compatible with bakery.Oven.NewMacaroon,
+// but the root key is never seen by the client. The macaroon
+// holds the namespace attached to the context with
+// ContextWithNamespace, if any.
+func (c *Client) NewMacaroon(ctx context.Context, version bakery.Version, expiry time.Time, caveats []checkers.Caveat, ops ...bakery.Op) (*bakery.Macaroon, error) {
+	ns, _ := ctx.Value(namespaceKey{}).(*checkers.Namespace)
+	resp, err := c.MintMacaroon(ctx, &params.MintMacaroonRequest{
+		Body: params.MintMacaroonRequestBody{
+			Version:   version,
+			Expiry:    expiry,
+			Caveats:   caveats,
+			Ops:       ops,
+			Namespace: ns,
+		},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return resp.Macaroon, nil
+}
+
+// MacaroonOps implements bakery.MacaroonOpStore.MacaroonOps
+// by asking the macaroond server to verify the macaroon.
+func (c *Client) MacaroonOps(ctx context.Context, ms macaroon.Slice) ([]bakery.Op, []string, error) {
+	resp, err := c.VerifyMacaroon(ctx, &params.VerifyMacaroonRequest{
+		Body: params.VerifyMacaroonRequestBody{
+			Macaroons: ms,
+		},
+	})
+	if err == nil {
+		return resp.Ops, resp.Conditions, nil
+	}
+	if errgo.Cause(err) == params.ErrVerificationFailed {
+		return nil, nil, &bakery.VerificationError{
+			Reason: err,
 		}
-		tokenData = base64.RawURLEncoding.EncodeToString(tokenData0)
 	}
-	c.accessToken = tokenData
+	return nil, nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+}
+
+// CheckMacaroons asks the macaroond server to check that
+// the given macaroons allow all the given operations
+// in the given context, resolving caveat conditions with
+// the given namespace, which may be nil. Conditions named by
+// the given policy, which may also be nil, are checked against it.
+// The response holds any first party caveat conditions that
+// the server did not recognize.
+func (c *Client) CheckMacaroons(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, ns *checkers.Namespace, pol *policy.Policy) (*params.CheckMacaroonResponse, error) {
+	resp, err := c.CheckMacaroon(ctx, &params.CheckMacaroonRequest{
+		Body: params.CheckMacaroonRequestBody{
+			Macaroons: mss,
+			Ops:       ops,
+			Context:   checkCtx,
+			Namespace: ns,
+			Policy:    pol.Rules(),
+		},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked), errgo.Is(params.ErrVerificationFailed))
+	}
+	return resp, nil
+}
+
+// CheckOps is like CheckMacaroons except that it checks each
+// operation separately and returns the status of each one.
+// It does not return an error when operations are not allowed.
+func (c *Client) CheckOps(ctx context.Context, mss []macaroon.Slice, ops []bakery.Op, checkCtx params.CheckContext, ns *checkers.Namespace, pol *policy.Policy) ([]params.OpStatus, error) {
+	resp, err := c.CheckMacaroon(ctx, &params.CheckMacaroonRequest{
+		Body: params.CheckMacaroonRequestBody{
+			Macaroons: mss,
+			Ops:       ops,
+			Context:   checkCtx,
+			Namespace: ns,
+			Any:       true,
+			Policy:    pol.Rules(),
+		},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return resp.Ops, nil
+}
+
+type namespaceKey struct{}
+
+// ContextWithNamespace returns a context that causes
+// Client.NewMacaroon to embed the given namespace
+// in the new macaroon.
+func ContextWithNamespace(ctx context.Context, ns *checkers.Namespace) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, ns)
+}
+
+func (c *Client) setAccessToken(ms bakery.Slice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ms
+	c.accessToken = ""
+	c.tokenGen++
+}
+
+// encodedAccessToken returns the access token bound to its
+// discharges and encoded for sending in the Macaroons header,
+// acquiring the discharges if needed. It returns the empty
+// string if there is no access token.
+//
+// The discharges are acquired without holding c.mu, so that
+// a slow or interactive discharge does not block other uses
+// of the client.
+func (c *Client) encodedAccessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, accessToken, gen := c.token, c.accessToken, c.tokenGen
+	c.mu.Unlock()
+	if accessToken != "" || len(token) == 0 {
+		return accessToken, nil
+	}
+	ms, err := token.DischargeAll(ctx, c.discharger.AcquireDischarge, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot discharge access token")
+	}
+	data, err := json.Marshal(ms.Bind())
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	accessToken = base64.RawURLEncoding.EncodeToString(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokenGen == gen {
+		c.accessToken = accessToken
+	}
+	return accessToken, nil
 }
 
 type clientDoer struct {
@@ -92,20 +391,24 @@ type clientDoer struct {
 }
 
 func (c *clientDoer) Do(req *http.Request) (*http.Response, error) {
-	if c.c.accessToken != "" {
-		req.Header.Set(httpbakery.MacaroonsHeader, c.c.accessToken)
+	accessToken, err := c.c.encodedAccessToken(req.Context())
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if accessToken != "" {
+		req.Header.Set(httpbakery.MacaroonsHeader, accessToken)
 	}
 	return c.httpClient.Do(req)
 }
 
-func (c *Client) Login(ctx context.Context, password string) (*bakery.Macaroon, error) {
-	resp, err := c.Access(ctx, &params.AccessRequest{
-		Password: password,
-	})
+// Login acquires an access macaroon from the server and uses it
+// for subsequent requests. The request's Lifetime and Ops
+// fields can be used to restrict the macaroon's capabilities.
+func (c *Client) Login(ctx context.Context, req *params.AccessRequest) (*bakery.Macaroon, error) {
+	resp, err := c.Access(ctx, req)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrInitialPasswordNeeded))
 	}
-	// TODO discharge if necessary
-	c.setAccessToken(bakery.Slice{resp.Macaroon}.Bind())
+	c.setAccessToken(bakery.Slice{resp.Macaroon})
 	return resp.Macaroon, nil
 }
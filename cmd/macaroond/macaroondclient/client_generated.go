@@ -19,18 +19,64 @@ func (c *client) Access(ctx context.Context, p *params.AccessRequest) (*params.A
 	return r, err
 }
 
+func (c *client) CheckMacaroon(ctx context.Context, p *params.CheckMacaroonRequest) (*params.CheckMacaroonResponse, error) {
+	var r *params.CheckMacaroonResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+func (c *client) FindOps(ctx context.Context, p *params.FindOpsRequest) (*params.FindOpsResponse, error) {
+	var r *params.FindOpsResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 func (c *client) FindRootKey(ctx context.Context, p *params.FindRootKeyRequest) (*params.FindRootKeyResponse, error) {
 	var r *params.FindRootKeyResponse
 	err := c.Client.Call(ctx, p, &r)
 	return r, err
 }
 
+func (c *client) GetKeyPair(ctx context.Context, p *params.GetKeyPairRequest) (*params.GetKeyPairResponse, error) {
+	var r *params.GetKeyPairResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+func (c *client) Lock(ctx context.Context, p *params.LockRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+func (c *client) MintMacaroon(ctx context.Context, p *params.MintMacaroonRequest) (*params.MintMacaroonResponse, error) {
+	var r *params.MintMacaroonResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 func (c *client) NewRootKey(ctx context.Context, p *params.NewRootKeyRequest) (*params.NewRootKeyResponse, error) {
 	var r *params.NewRootKeyResponse
 	err := c.Client.Call(ctx, p, &r)
 	return r, err
 }
 
+func (c *client) SetKeyPair(ctx context.Context, p *params.SetKeyPairRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 func (c *client) SetPassword(ctx context.Context, p *params.SetPasswordRequest) error {
 	return c.Client.Call(ctx, p, nil)
 }
+
+func (c *client) StoreOps(ctx context.Context, p *params.StoreOpsRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+func (c *client) Unlock(ctx context.Context, p *params.UnlockRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+func (c *client) VerifyMacaroon(ctx context.Context, p *params.VerifyMacaroonRequest) (*params.VerifyMacaroonResponse, error) {
+	var r *params.VerifyMacaroonResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
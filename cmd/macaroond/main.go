@@ -1,25 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/juju/loggo"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rogpeppe/macaroon-cmd/params"
 	errgo "gopkg.in/errgo.v1"
-	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 )
 
 var logger = loggo.GetLogger("macaroond")
 
+// sweepInterval holds how often expired root keys are removed.
+const sweepInterval = 10 * time.Minute
+
 var (
-	netTypeFlag = flag.String("t", params.DefaultNetwork, "type of network to listen on (e.g. tcp)")
-	addrFlag    = flag.String("addr", params.DefaultAddress, "address or socket path to listen on")
+	netTypeFlag   = flag.String("t", params.DefaultNetwork, "type of network to listen on (unix, tcp or tls)")
+	addrFlag      = flag.String("addr", params.DefaultAddress, "address or socket path to listen on")
+	rotateFlag    = flag.Duration("rotate", 24*time.Hour, "how often to create a new root key")
+	idleFlag      = flag.Duration("idle-timeout", 0, "lock the server after it has been idle for this long (0 means never)")
+	maxAccessFlag = flag.Duration("max-access-lifetime", 24*time.Hour, "maximum lifetime of access tokens")
+	maxKeyFlag    = flag.Duration("max-key-lifetime", 30*24*time.Hour, "maximum lifetime of root keys and stored operations requested by clients (0 means no limit)")
+	allowUidFlag  = flag.String("allow-uid", "", "comma-separated user ids that may obtain access tokens without a password (unix network on linux only)")
+	tlsCertFlag   = flag.String("tls-cert", "", "PEM file holding the TLS server certificate (tls network only)")
+	tlsKeyFlag    = flag.String("tls-key", "", "PEM file holding the TLS server private key (tls network only)")
+	clientCAFlag  = flag.String("tls-client-ca", "", "PEM file holding CA certificates that client certificates must be signed by; if empty, client certificates are not required")
 )
 
 func main() {
@@ -33,40 +48,157 @@ func main() {
 		flag.Usage()
 	}
 	dir := flag.Arg(0)
-	if err := main1(*netTypeFlag, *addrFlag, dir); err != nil {
+	allowedUids, err := parseUids(*allowUidFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(allowedUids) > 0 && *netTypeFlag != "unix" {
+		log.Fatal("-allow-uid can only be used with the unix network")
+	}
+	if len(allowedUids) > 0 && !peerCredSupported {
+		log.Fatalf("-allow-uid is not supported on %s", runtime.GOOS)
+	}
+	if *netTypeFlag == "tls" {
+		if *tlsCertFlag == "" || *tlsKeyFlag == "" {
+			log.Fatal("-tls-cert and -tls-key must be specified with the tls network")
+		}
+	} else if *tlsCertFlag != "" || *tlsKeyFlag != "" || *clientCAFlag != "" {
+		log.Fatal("TLS flags can only be used with the tls network")
+	}
+	if err := main1(*netTypeFlag, *addrFlag, dir, config{
+		rotatePeriod:      *rotateFlag,
+		idleTimeout:       *idleFlag,
+		maxAccessLifetime: *maxAccessFlag,
+		maxKeyLifetime:    *maxKeyFlag,
+		allowedUids:       allowedUids,
+		tlsCert:           *tlsCertFlag,
+		tlsKey:            *tlsKeyFlag,
+		tlsClientCA:       *clientCAFlag,
+	}); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func main1(netw string, addr string, dir string) error {
-	if _, err := os.Stat(dir); err != nil {
-		// TODO create directory?
-		return errgo.Mask(err)
+// config holds configuration parameters for the server.
+type config struct {
+	// rotatePeriod holds how often a new root key is created.
+	rotatePeriod time.Duration
+
+	// idleTimeout holds how long the server can be idle
+	// before it locks itself. If it is zero, the server
+	// never locks itself.
+	idleTimeout time.Duration
+
+	// maxAccessLifetime holds the maximum lifetime
+	// of an access macaroon.
+	maxAccessLifetime time.Duration
+
+	// maxKeyLifetime holds the maximum lifetime of root
+	// keys and stored operations that clients may request.
+	// If it is zero, there is no maximum.
+	maxKeyLifetime time.Duration
+
+	// allowedUids holds the user ids of local processes
+	// that may obtain access macaroons without a password.
+	allowedUids []int
+
+	// tlsCert, tlsKey and tlsClientCA hold the paths to
+	// the PEM files used when serving TLS.
+	// See serverTLSConfig.
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+}
+
+// parseUids parses a comma-separated list of user ids.
+func parseUids(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var uids []int
+	for _, f := range strings.Split(s, ",") {
+		uid, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || uid < 0 {
+			return nil, errgo.Newf("invalid user id %q", f)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// sharedSocket reports whether the unix socket must be
+// accessible to users other than the current one so that
+// processes running as the given user ids can connect to it.
+func sharedSocket(uids []int) bool {
+	for _, uid := range uids {
+		if uid != os.Getuid() {
+			return true
+		}
 	}
-	listener, err := net.Listen(netw, addr)
+	return false
+}
+
+func main1(netw string, addr string, dir string, cfg config) error {
+	store, err := openStorage(dir)
 	if err != nil {
-		if netw == "unix" {
-			// TODO only do this if the socket can't be connected to?
-			os.Remove(addr)
-			listener, err = net.Listen(netw, addr)
+		return errgo.Mask(err)
+	}
+	defer store.Close()
+	for _, dir := range []string{rootKeyDir, accessKeyDir, opsDir} {
+		if err := store.mkdir(dir); err != nil {
+			return errgo.Notef(err, "cannot create directory")
 		}
+	}
+	var listener net.Listener
+	switch netw {
+	case "unix":
+		listener, err = listenUnix(addr, sharedSocket(cfg.allowedUids))
+	case "tls":
+		listener, err = net.Listen("tcp", addr)
+	default:
+		listener, err = net.Listen(netw, addr)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot listen on network %q, addr %q", netw, addr)
+	}
+	if netw == "tls" {
+		tlsConfig, err := serverTLSConfig(cfg.tlsCert, cfg.tlsKey, cfg.tlsClientCA)
 		if err != nil {
-			return errgo.Notef(err, "cannot listen on network %q, addr %q", netw, addr)
+			listener.Close()
+			return errgo.Mask(err)
 		}
+		listener = tls.NewListener(listener, tlsConfig)
 	}
 	log.Printf("successfully listened on %v!%v", netw, addr)
 	srv := &server{
-		dir: dir,
-		bakery: bakery.New(bakery.BakeryParams{
-			Location: "macaroond",
-		}),
+		store:             store,
+		maxAccessLifetime: cfg.maxAccessLifetime,
+		maxKeyLifetime:    cfg.maxKeyLifetime,
+		allowedUids:       make(map[int]bool),
+		sharedSocket:      netw == "unix" && sharedSocket(cfg.allowedUids),
 	}
+	for _, uid := range cfg.allowedUids {
+		srv.allowedUids[uid] = true
+	}
+	srv.rootKeys = newRootKeyStore(srv, store, rootKeyDir, cfg.rotatePeriod)
+	srv.accessKeys = newRootKeyStore(srv, store, accessKeyDir, cfg.rotatePeriod)
+	srv.ops = newOpsStore(store, opsDir)
 	if err := srv.readEncryptedMasterKey(); err != nil {
 		return errgo.Notef(err, "cannot read root key file")
 	}
+	go srv.runSweeper(sweepInterval)
+	if cfg.idleTimeout > 0 {
+		go srv.runIdleLocker(cfg.idleTimeout)
+	}
 	mux := httprouter.New()
 	for _, h := range serverParams.Handlers(srv.newHandler) {
 		mux.Handle(h.Method, h.Path, h.Handle)
 	}
-	return http.Serve(listener, mux)
+	httpServer := &http.Server{
+		Handler: mux,
+	}
+	if netw == "unix" {
+		httpServer.ConnContext = connContext
+	}
+	return httpServer.Serve(listener)
 }
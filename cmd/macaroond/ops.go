@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+)
+
+// opsStore implements bakery.MultiOpStore by storing each
+// set of operations in its own file inside the directory dir
+// within the storage. The operations are not secret, so they
+// are not encrypted and can be used when the server is locked.
+type opsStore struct {
+	store *storage
+	dir   string
+
+	mu sync.Mutex
+}
+
+// storedOps holds the on-disk representation of a set of operations.
+type storedOps struct {
+	Key     string      `json:"key"`
+	Expires time.Time   `json:"expires"`
+	Ops     []bakery.Op `json:"ops"`
+}
+
+var _ bakery.MultiOpStore = (*opsStore)(nil)
+
+func newOpsStore(store *storage, dir string) *opsStore {
+	return &opsStore{
+		store: store,
+		dir:   dir,
+	}
+}
+
+// PutOps implements bakery.MultiOpStore.PutOps. The operations
+// will be kept at least until the given expiry time. If expiry
+// is zero, defaultRootKeyExpiry will be used.
+//
+// The operations stored under a key are never changed, because
+// macaroons that have already been minted refer to them. If the
+// key is already in use, its expiry time may be extended, but
+// it is an error if the operations differ.
+func (s *opsStore) PutOps(ctx context.Context, key string, ops []bakery.Op, expiry time.Time) error {
+	if expiry.IsZero() {
+		expiry = time.Now().Add(defaultRootKeyExpiry)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stored storedOps
+	err := s.store.readJSON(s.opsPath(key), &stored)
+	switch {
+	case err == nil && stored.Key == key && time.Now().Before(stored.Expires):
+		if !opsEqual(stored.Ops, ops) {
+			return errgo.Newf("different operations already stored with key %q", key)
+		}
+		if !expiry.After(stored.Expires) {
+			// They're already stored for long enough.
+			return nil
+		}
+		ops = stored.Ops
+	case err != nil && !os.IsNotExist(errgo.Cause(err)):
+		return errgo.Notef(err, "cannot read operations")
+	}
+	if err := s.store.writeJSON(s.opsPath(key), storedOps{
+		Key:     key,
+		Expires: expiry.Round(time.Millisecond),
+		Ops:     ops,
+	}); err != nil {
+		return errgo.Notef(err, "cannot write operations")
+	}
+	return nil
+}
+
+// GetOps implements bakery.MultiOpStore.GetOps. It returns
+// an error with a bakery.ErrNotFound cause if there are no
+// operations stored with the given key or they have expired.
+func (s *opsStore) GetOps(ctx context.Context, key string) ([]bakery.Op, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stored storedOps
+	if err := s.store.readJSON(s.opsPath(key), &stored); err != nil {
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil, errgo.WithCausef(nil, bakery.ErrNotFound, "operations not found")
+		}
+		return nil, errgo.Notef(err, "cannot read operations")
+	}
+	if stored.Key != key || !time.Now().Before(stored.Expires) {
+		return nil, errgo.WithCausef(nil, bakery.ErrNotFound, "operations not found")
+	}
+	return stored.Ops, nil
+}
+
+// removeExpired removes all the operations that have expired.
+func (s *opsStore) removeExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.store.list(s.dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := time.Now()
+	for _, name := range names {
+		p := path.Join(s.dir, name)
+		var stored storedOps
+		if err := s.store.readJSON(p, &stored); err != nil {
+			logger.Errorf("ignoring invalid operations file %q: %v", name, err)
+			continue
+		}
+		if now.Before(stored.Expires) {
+			continue
+		}
+		if err := s.store.remove(p); err != nil {
+			return errgo.Notef(err, "cannot remove expired operations")
+		}
+	}
+	return nil
+}
+
+// opsPath returns the path within the storage of the file
+// holding the operations with the given key. The key is
+// hashed because it may contain characters that are not
+// valid in file names.
+func (s *opsStore) opsPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// multiOpEntity returns the entity that bakery.Oven uses in place of
+// the given operations, which must be canonical (see bakery.CanonicalOps),
+// and under which it stores them in its bakery.MultiOpStore.
+func multiOpEntity(ops []bakery.Op) string {
+	h := sha256.New()
+	for _, op := range ops {
+		h.Write([]byte(op.Action + "\n" + op.Entity + "\n"))
+	}
+	return "multi-" + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// opsEqual reports whether the two sets of operations
+// are the same, ignoring order and duplicates.
+func opsEqual(ops0, ops1 []bakery.Op) bool {
+	ops0, ops1 = bakery.CanonicalOps(ops0), bakery.CanonicalOps(ops1)
+	if len(ops0) != len(ops1) {
+		return false
+	}
+	for i := range ops0 {
+		if ops0[i] != ops1[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+)
+
+func TestOpsStore(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+	err = st.mkdir(opsDir)
+	c.Assert(err, qt.Equals, nil)
+
+	ctx := context.Background()
+	store := newOpsStore(st, opsDir)
+	ops := []bakery.Op{{
+		Entity: "a",
+		Action: "read",
+	}, {
+		Entity: "b",
+		Action: "write",
+	}}
+	err = store.PutOps(ctx, "key1", ops, time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = store.PutOps(ctx, "key/2", ops, time.Now().Add(-time.Second))
+	c.Assert(err, qt.Equals, nil)
+
+	// A new store finds the stored operations.
+	store = newOpsStore(st, opsDir)
+	gotOps, err := store.GetOps(ctx, "key1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gotOps, qt.DeepEquals, ops)
+
+	_, err = store.GetOps(ctx, "key/2")
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+
+	_, err = store.GetOps(ctx, "other")
+	c.Assert(errgo.Cause(err), qt.Equals, bakery.ErrNotFound)
+
+	// Expired operations are removed.
+	err = store.removeExpired()
+	c.Assert(err, qt.Equals, nil)
+	names, err := st.list(opsDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(len(names), qt.Equals, 1)
+}
+
+func TestOpsStoreDoesNotReplaceOps(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+	err = st.mkdir(opsDir)
+	c.Assert(err, qt.Equals, nil)
+
+	ctx := context.Background()
+	store := newOpsStore(st, opsDir)
+	ops := []bakery.Op{{
+		Entity: "a",
+		Action: "read",
+	}, {
+		Entity: "b",
+		Action: "write",
+	}}
+	expiry := time.Now().Add(time.Hour).Round(time.Millisecond)
+	err = store.PutOps(ctx, "key", ops, expiry)
+	c.Assert(err, qt.Equals, nil)
+
+	// Different operations can't be stored under the same key.
+	err = store.PutOps(ctx, "key", []bakery.Op{{
+		Entity: "a",
+		Action: "write",
+	}}, expiry.Add(time.Hour))
+	c.Assert(err, qt.ErrorMatches, `different operations already stored with key "key"`)
+
+	// The same operations in a different order extend the expiry.
+	err = store.PutOps(ctx, "key", []bakery.Op{ops[1], ops[0]}, expiry.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	var stored storedOps
+	err = st.readJSON(store.opsPath("key"), &stored)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(stored.Expires.Equal(expiry.Add(time.Hour)), qt.Equals, true)
+	c.Assert(stored.Ops, qt.DeepEquals, ops)
+}
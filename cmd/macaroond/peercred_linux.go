@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// peerCredSupported holds whether peerUid can
+// find out the user id of a connection's peer.
+const peerCredSupported = true
+
+// peerUid returns the user id of the process at the
+// other end of the given unix socket connection.
+func peerUid(conn net.Conn) (int, error) {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, errgo.Newf("not a unix socket connection")
+	}
+	rawConn, err := uconn.SyscallConn()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	if credErr != nil {
+		return 0, errgo.Notef(credErr, "cannot get peer credentials")
+	}
+	return int(cred.Uid), nil
+}
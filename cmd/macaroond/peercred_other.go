@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"runtime"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// peerCredSupported holds whether peerUid can
+// find out the user id of a connection's peer.
+const peerCredSupported = false
+
+// peerUid returns the user id of the process at the
+// other end of the given unix socket connection.
+func peerUid(conn net.Conn) (int, error) {
+	return 0, errgo.Newf("peer credentials not supported on %s", runtime.GOOS)
+}
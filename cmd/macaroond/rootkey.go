@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+// defaultRootKeyExpiry holds the length of time that a root key
+// lasts when the client does not specify an expiry time.
+const defaultRootKeyExpiry = 24 * time.Hour
+
+// legacyRootKeyId holds the id that was used for all macaroons
+// before root keys were stored separately. The root key for
+// that id is the master key itself.
+const legacyRootKeyId = "0"
+
+// rootKeyStore holds the root keys created by the server.
+// Each root key is stored in its own file inside the
+// directory dir within the storage, encrypted with the
+// server's master key.
+type rootKeyStore struct {
+	srv   *server
+	store *storage
+	dir   string
+
+	// rotatePeriod holds the length of time that a root
+	// key will be used for creating new macaroons.
+	rotatePeriod time.Duration
+
+	mu sync.Mutex
+	// current holds the most recently created root key.
+	current *rootKey
+	// keys holds all the root keys that have been decrypted
+	// so far, keyed by id.
+	keys map[string]*rootKey
+}
+
+// rootKey holds a decrypted root key.
+type rootKey struct {
+	id      string
+	created time.Time
+	expires time.Time
+	key     []byte
+}
+
+// storedRootKey holds the on-disk representation of a root key.
+// The creation and expiry times are not encrypted so that
+// expired keys can be removed even when the server is locked.
+type storedRootKey struct {
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	EncryptedKey []byte    `json:"encryptedKey"`
+}
+
+func (k *rootKey) stored(masterKey []byte) storedRootKey {
+	return storedRootKey{
+		Created:      k.created,
+		Expires:      k.expires,
+		EncryptedKey: sealWithKey(k.key, masterKey),
+	}
+}
+
+func newRootKeyStore(srv *server, store *storage, dir string, rotatePeriod time.Duration) *rootKeyStore {
+	return &rootKeyStore{
+		srv:          srv,
+		store:        store,
+		dir:          dir,
+		rotatePeriod: rotatePeriod,
+		keys:         make(map[string]*rootKey),
+	}
+}
+
+// checkExpiry checks that an expiry time requested by a
+// client for a root key or stored operations is no more
+// than max in the future, returning an error with a
+// params.ErrBadRequest cause if it is. If max is zero,
+// any expiry time is allowed.
+func checkExpiry(expiry time.Time, max time.Duration) error {
+	if max <= 0 || !expiry.After(time.Now().Add(max)) {
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrBadRequest, "expiry time %v is more than %v in the future", expiry, max)
+}
+
+// newKey returns a root key suitable for creating a new macaroon
+// that expires at the given time. A new key is created if the
+// current one is older than the rotation period. If expires is zero,
+// defaultRootKeyExpiry will be used. It returns an error with a
+// params.ErrBadRequest cause if expires is not in the future.
+//
+// The expiry time of the returned key will be at least expires.
+func (s *rootKeyStore) newKey(expires time.Time) (*rootKey, error) {
+	if expires.IsZero() {
+		expires = time.Now().Add(defaultRootKeyExpiry)
+	} else if !expires.After(time.Now()) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "expiry time %v is not in the future", expires)
+	}
+	expires = expires.Round(time.Millisecond)
+	// Note that the master key must be obtained with s.mu held
+	// so that keys are never written with a master key that
+	// has been replaced by rekey.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	masterKeys, err := s.srv.getMasterKeys()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	masterKey := masterKeys[0]
+	if s.current == nil {
+		// We haven't looked yet, so find the most recent key
+		// that was stored by a previous server instance.
+		current, err := s.latestKey(masterKeys)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		s.current = current
+	}
+	if s.current != nil && time.Since(s.current.created) < s.rotatePeriod && time.Now().Before(s.current.expires) {
+		if err := s.extendExpiry(s.current, expires, masterKey); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return s.current, nil
+	}
+	key, err := s.createKey(expires, masterKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	s.current = key
+	return key, nil
+}
+
+// findKey returns the root key with the given id.
+// It returns an error with a params.ErrNotFound cause
+// if the key is not found.
+func (s *rootKeyStore) findKey(id string) (*rootKey, error) {
+	if !validRootKeyId(id) {
+		return nil, params.ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	masterKeys, err := s.srv.getMasterKeys()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	key := s.keys[id]
+	if key == nil {
+		key, err = s.readKey(id, masterKeys)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+	}
+	if !time.Now().Before(key.expires) {
+		// The key has expired but has not yet been
+		// removed by the sweeper.
+		return nil, params.ErrNotFound
+	}
+	return key, nil
+}
+
+// forget discards all decrypted root keys. The keys are not
+// wiped because they may still be in use by requests
+// that are in progress.
+func (s *rootKeyStore) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = make(map[string]*rootKey)
+	s.current = nil
+}
+
+// removeAll removes all the keys in the store.
+func (s *rootKeyStore) removeAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.store.list(s.dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, id := range ids {
+		if !validRootKeyId(id) {
+			continue
+		}
+		if err := s.store.remove(s.keyPath(id)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	s.keys = make(map[string]*rootKey)
+	s.current = nil
+	return nil
+}
+
+// removeExpired removes all the keys that have expired.
+// It does not need the master key, so it can be called
+// when the server is locked.
+func (s *rootKeyStore) removeExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.store.list(s.dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := time.Now()
+	for _, id := range ids {
+		if !validRootKeyId(id) {
+			continue
+		}
+		var stored storedRootKey
+		if err := s.store.readJSON(s.keyPath(id), &stored); err != nil {
+			logger.Errorf("ignoring invalid root key file %q: %v", id, err)
+			continue
+		}
+		if now.Before(stored.Expires) {
+			continue
+		}
+		if err := s.store.remove(s.keyPath(id)); err != nil {
+			return errgo.Notef(err, "cannot remove expired root key")
+		}
+		delete(s.keys, id)
+		if s.current != nil && s.current.id == id {
+			s.current = nil
+		}
+		logger.Infof("removed expired root key %q", id)
+	}
+	return nil
+}
+
+// rekey re-encrypts all the keys in the store that are
+// encrypted with oldMasterKey so that they are encrypted
+// with masterKey.
+func (s *rootKeyStore) rekey(oldMasterKey, masterKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.store.list(s.dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, id := range ids {
+		if !validRootKeyId(id) {
+			continue
+		}
+		var stored storedRootKey
+		if err := s.store.readJSON(s.keyPath(id), &stored); err != nil {
+			logger.Errorf("ignoring invalid root key file %q: %v", id, err)
+			continue
+		}
+		encryptedKey, changed, err := resealWithKey(stored.EncryptedKey, oldMasterKey, masterKey)
+		if err != nil {
+			return errgo.Notef(err, "cannot decrypt root key %q", id)
+		}
+		if !changed {
+			continue
+		}
+		stored.EncryptedKey = encryptedKey
+		if err := s.store.writeJSON(s.keyPath(id), stored); err != nil {
+			return errgo.Notef(err, "cannot write root key %q", id)
+		}
+	}
+	return nil
+}
+
+// extendExpiry extends the expiry time of the given key
+// so that it lasts at least until the given time.
+// Called with s.mu held.
+func (s *rootKeyStore) extendExpiry(key *rootKey, expires time.Time, masterKey []byte) error {
+	if !expires.After(key.expires) {
+		return nil
+	}
+	key1 := *key
+	key1.expires = expires
+	if err := s.store.writeJSON(s.keyPath(key.id), key1.stored(masterKey)); err != nil {
+		return errgo.Notef(err, "cannot update root key expiry")
+	}
+	key.expires = expires
+	return nil
+}
+
+// createKey creates a new root key and stores it.
+// Called with s.mu held.
+func (s *rootKeyStore) createKey(expires time.Time, masterKey []byte) (*rootKey, error) {
+	idBytes, err := randomBytes(16)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keyBytes, err := randomBytes(24)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	key := &rootKey{
+		id:      hex.EncodeToString(idBytes),
+		created: time.Now().Round(time.Millisecond),
+		expires: expires,
+		key:     keyBytes,
+	}
+	if err := s.store.writeJSON(s.keyPath(key.id), key.stored(masterKey)); err != nil {
+		return nil, errgo.Notef(err, "cannot store root key")
+	}
+	s.keys[key.id] = key
+	return key, nil
+}
+
+// readKey reads and decrypts the root key with the given id,
+// which may be encrypted with any of the given master keys.
+// Called with s.mu held.
+func (s *rootKeyStore) readKey(id string, masterKeys [][]byte) (*rootKey, error) {
+	var stored storedRootKey
+	if err := s.store.readJSON(s.keyPath(id), &stored); err != nil {
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil, params.ErrNotFound
+		}
+		return nil, errgo.Notef(err, "cannot read root key %q", id)
+	}
+	keyBytes, err := openWithKeys(stored.EncryptedKey, masterKeys)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt root key %q", id)
+	}
+	key := &rootKey{
+		id:      id,
+		created: stored.Created,
+		expires: stored.Expires,
+		key:     keyBytes,
+	}
+	s.keys[id] = key
+	return key, nil
+}
+
+// latestKey returns the most recently created key in the store,
+// or nil if there are none.
+// Called with s.mu held.
+func (s *rootKeyStore) latestKey(masterKeys [][]byte) (*rootKey, error) {
+	ids, err := s.store.list(s.dir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var latestId string
+	var latestCreated time.Time
+	for _, id := range ids {
+		if !validRootKeyId(id) {
+			continue
+		}
+		var stored storedRootKey
+		if err := s.store.readJSON(s.keyPath(id), &stored); err != nil {
+			logger.Errorf("ignoring invalid root key file %q: %v", id, err)
+			continue
+		}
+		if stored.Created.After(latestCreated) {
+			latestId, latestCreated = id, stored.Created
+		}
+	}
+	if latestId == "" {
+		return nil, nil
+	}
+	return s.readKey(latestId, masterKeys)
+}
+
+// keyPath returns the name of the file holding the
+// root key with the given id.
+func (s *rootKeyStore) keyPath(id string) string {
+	return path.Join(s.dir, id)
+}
+
+// validRootKeyId reports whether id is a well formed
+// root key id. This guards against attempts to access
+// files outside the root key directory.
+func validRootKeyId(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// bakeryRootKeyStore implements bakery.RootKeyStore
+// by using a rootKeyStore.
+type bakeryRootKeyStore struct {
+	keys *rootKeyStore
+}
+
+// Get implements bakery.RootKeyStore.Get.
+func (s bakeryRootKeyStore) Get(ctx context.Context, id []byte) ([]byte, error) {
+	key, err := s.keys.findKey(string(id))
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, bakery.ErrNotFound
+		}
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	return key.key, nil
+}
+
+// RootKey implements bakery.RootKeyStore.RootKey.
+// The expiry time of the macaroon being created can be
+// specified with contextWithExpiry.
+func (s bakeryRootKeyStore) RootKey(ctx context.Context) (rootKey, id []byte, err error) {
+	expiry, _ := ctx.Value(expiryKey{}).(time.Time)
+	key, err := s.keys.newKey(expiry)
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrLocked), errgo.Is(params.ErrBadRequest))
+	}
+	return key.key, []byte(key.id), nil
+}
+
+type expiryKey struct{}
+
+// contextWithExpiry returns a context that causes
+// bakeryRootKeyStore.RootKey to return a key that
+// lasts at least until the given time.
+func contextWithExpiry(ctx context.Context, expiry time.Time) context.Context {
+	return context.WithValue(ctx, expiryKey{}, expiry)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+func TestRootKeyStore(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+	err = st.mkdir(rootKeyDir)
+	c.Assert(err, qt.Equals, nil)
+
+	srv := &server{
+		store:     st,
+		masterKey: []byte("012345678901234567890123"),
+	}
+	store := newRootKeyStore(srv, st, rootKeyDir, time.Hour)
+
+	key1, err := store.newKey(time.Now().Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	// The same key is used while the rotation period hasn't passed,
+	// but its expiry is extended.
+	expires := time.Now().Add(time.Hour)
+	key2, err := store.newKey(expires)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key2.id, qt.Equals, key1.id)
+	c.Assert(key2.expires.Before(expires.Add(-time.Millisecond)), qt.Equals, false)
+
+	// A new store finds the stored key.
+	store = newRootKeyStore(srv, st, rootKeyDir, time.Hour)
+	key3, err := store.findKey(key1.id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(key3.key), qt.Equals, string(key1.key))
+	c.Assert(key3.expires.Equal(key2.expires), qt.Equals, true)
+
+	// Expiry times in the past are rejected.
+	_, err = store.newKey(time.Now().Add(-time.Minute))
+	c.Assert(err, qt.ErrorMatches, `expiry time .* is not in the future`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	// A new key is created when the rotation period has passed.
+	store.rotatePeriod = 0
+	key4, err := store.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key4.id != key1.id, qt.Equals, true)
+
+	// Expired keys are removed.
+	_, err = store.createKey(time.Now().Add(-time.Second), srv.masterKey)
+	c.Assert(err, qt.Equals, nil)
+	err = store.removeExpired()
+	c.Assert(err, qt.Equals, nil)
+	ids, err := st.list(rootKeyDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(len(ids), qt.Equals, 2)
+
+	_, err = store.findKey("0123456789abcdef0123456789abcdef")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func TestCheckExpiry(t *testing.T) {
+	c := qt.New(t)
+	now := time.Now()
+	c.Assert(checkExpiry(time.Time{}, time.Hour), qt.Equals, nil)
+	c.Assert(checkExpiry(now.Add(time.Minute), time.Hour), qt.Equals, nil)
+	c.Assert(checkExpiry(now.Add(1000*time.Hour), 0), qt.Equals, nil)
+	err := checkExpiry(now.Add(2*time.Hour), time.Hour)
+	c.Assert(err, qt.ErrorMatches, `expiry time .* is more than 1h0m0s in the future`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
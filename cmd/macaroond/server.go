@@ -2,155 +2,627 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/juju/httprequest"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
 )
 
 var serverParams = httprequest.Server{
 	ErrorMapper: errorToResponse,
 }
 
+// Names of files and directories in the storage directory.
+const (
+	masterKeyFile = "masterkey"
+	rootKeyDir    = "rootkeys"
+	accessKeyDir  = "accesskeys"
+	opsDir        = "ops"
+	keyPairFile   = "keypair"
+
+	// bakeryKeyFile holds the key pair used by the server's
+	// own bakeries, encrypted with the master key. Unlike
+	// the key pair in keyPairFile, it is never given to clients.
+	bakeryKeyFile = "serverkey"
+
+	// legacyBakeryKeyFile holds the unencrypted bakery key pair
+	// used by earlier versions of the server. If it exists when
+	// the bakery key is first created, it is used as the bakery key.
+	legacyBakeryKeyFile = "bakerykey"
+
+	// prevMasterKeyFile holds the previous master key,
+	// encrypted with the current master key, while stored
+	// data is being re-encrypted after a password change.
+	prevMasterKeyFile = "masterkey.prev"
+
+	// legacyKeyFile holds the root key used for legacy macaroons,
+	// encrypted with the master key. It is written when the master
+	// key is first replaced; until then the master key itself is
+	// the legacy root key.
+	legacyKeyFile = "legacykey"
+)
+
 type server struct {
-	dir    string
+	store    *storage
+	rootKeys *rootKeyStore
+
+	// bakeryMu guards bakery and oven, which use the bakery
+	// key and so are created when first needed after the
+	// server has been unlocked.
+	bakeryMu sync.Mutex
+
+	// bakery is used to create and check access macaroons.
+	// See accessBakery.
 	bakery *bakery.Bakery
 
+	// oven is used to mint and verify macaroons on behalf
+	// of clients, using root keys from rootKeys.
+	// See clientOven.
+	oven *bakery.Oven
+
+	// ops holds the operations for macaroons that
+	// are associated with more than one operation.
+	ops *opsStore
+
+	// accessKeys holds the root keys used for
+	// the access macaroons created by srv.bakery.
+	accessKeys *rootKeyStore
+
+	// maxAccessLifetime holds the maximum lifetime
+	// of an access macaroon.
+	maxAccessLifetime time.Duration
+
+	// maxKeyLifetime holds the maximum lifetime of root
+	// keys and stored operations that clients may request.
+	// If it is zero, there is no maximum.
+	maxKeyLifetime time.Duration
+
+	// allowedUids holds the user ids of local processes
+	// that may obtain access macaroons without a password.
+	allowedUids map[int]bool
+
+	// sharedSocket holds whether the server is listening on a
+	// unix socket that users other than the current one can
+	// connect to. If it is true, only processes running as the
+	// current user or one of allowedUids may use the server.
+	sharedSocket bool
+
+	// keyPairMu guards the stored key pairs.
+	keyPairMu sync.Mutex
+
+	// passwordMu serializes password changes and the
+	// re-encryption of stored data that follows them.
+	passwordMu sync.Mutex
+
 	mu                 sync.Mutex
 	encryptedMasterKey []byte
 	masterKey          []byte
+	// prevMasterKey holds the master key that was in use
+	// before the most recent password change while stored
+	// data is being re-encrypted with the new master key.
+	prevMasterKey []byte
+	// lastUsed holds the time that the master key
+	// was last used.
+	lastUsed time.Time
 }
 
-// needsPassword reports wh
+// needsPassword reports whether the initial password
+// has yet to be set.
 func (srv *server) needsPassword() bool {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	return srv.encryptedMasterKey == nil
 }
 
+// newAccessBakery returns a bakery used to create and check
+// the access macaroons that allow clients to use the server.
+// Its root keys are kept in the storage directory, so access
+// macaroons remain valid when the server is restarted.
+func (srv *server) newAccessBakery(key *bakery.KeyPair) *bakery.Bakery {
+	return bakery.New(bakery.BakeryParams{
+		Location: "macaroond",
+		Key:      key,
+		RootKeyStore: bakeryRootKeyStore{
+			keys: srv.accessKeys,
+		},
+	})
+}
+
+// newOven returns the oven used to mint and verify
+// macaroons for clients, so that clients never need
+// to see the root keys. New macaroons hold the given
+// namespace, or the standard namespace if it is nil.
+func (srv *server) newOven(key *bakery.KeyPair, ns *checkers.Namespace) *bakery.Oven {
+	rootKeys := bakeryRootKeyStore{
+		keys: srv.rootKeys,
+	}
+	return bakery.NewOven(bakery.OvenParams{
+		Key: key,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return rootKeys
+		},
+		OpsStore:  srv.ops,
+		Namespace: ns,
+	})
+}
+
+// accessBakery returns the bakery used to create and check the
+// access macaroons, creating it if needed. It returns an error
+// with a params.ErrLocked cause if the server is locked.
+func (srv *server) accessBakery() (*bakery.Bakery, error) {
+	if err := srv.initBakery(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	srv.bakeryMu.Lock()
+	defer srv.bakeryMu.Unlock()
+	return srv.bakery, nil
+}
+
+// clientOven returns the oven used to mint and verify macaroons
+// for clients, creating it if needed. It returns an error
+// with a params.ErrLocked cause if the server is locked.
+func (srv *server) clientOven() (*bakery.Oven, error) {
+	if err := srv.initBakery(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	srv.bakeryMu.Lock()
+	defer srv.bakeryMu.Unlock()
+	return srv.oven, nil
+}
+
+// initBakery creates srv.bakery and srv.oven if they have not been
+// created yet. They use the bakery key, which can only be
+// read when the server is unlocked.
+func (srv *server) initBakery() error {
+	srv.bakeryMu.Lock()
+	defer srv.bakeryMu.Unlock()
+	if srv.bakery != nil {
+		return nil
+	}
+	key, err := srv.bakeryKey()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	srv.bakery = srv.newAccessBakery(key)
+	srv.oven = srv.newOven(key, nil)
+	return nil
+}
+
+// resetBakery discards srv.bakery and srv.oven, and hence
+// the bakery key, so that they are created again when the
+// server is next unlocked.
+func (srv *server) resetBakery() {
+	srv.bakeryMu.Lock()
+	defer srv.bakeryMu.Unlock()
+	srv.bakery = nil
+	srv.oven = nil
+}
+
+type peerUidKey struct{}
+
+// connContext returns a context holding the user id of the
+// process at the other end of the given connection, if it
+// can be determined.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	uid, err := peerUid(conn)
+	if err != nil {
+		logger.Errorf("cannot determine peer user id: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerUidKey{}, uid)
+}
+
+// peerAllowed reports whether the request with the given
+// context comes from a process running as one of the
+// allowed user ids.
+func (srv *server) peerAllowed(ctx context.Context) bool {
+	uid, ok := ctx.Value(peerUidKey{}).(int)
+	return ok && srv.allowedUids[uid]
+}
+
+// peerPermitted reports whether the request with the given
+// context may use the server at all. When the unix socket is
+// shared with other users, the peer must be running as the
+// current user or one of the allowed user ids.
+func (srv *server) peerPermitted(ctx context.Context) bool {
+	if !srv.sharedSocket {
+		return true
+	}
+	uid, ok := ctx.Value(peerUidKey{}).(int)
+	return ok && (uid == os.Getuid() || srv.allowedUids[uid])
+}
+
+// isLocked reports whether the master key is unavailable.
+func (srv *server) isLocked() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.masterKey == nil
+}
+
 // checkPassword checks that the password is valid by decrypting
 // the master key. It also sets the srv.masterKey from the decrypted key.
+// If a previous password change was interrupted, the re-encryption
+// of stored data is completed when the server is unlocked.
 func (srv *server) checkPassword(password string) error {
+	unlocked, err := srv.checkPassword0(password)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !unlocked {
+		return nil
+	}
+	srv.passwordMu.Lock()
+	defer srv.passwordMu.Unlock()
+	// The password may have been changed since we unlocked,
+	// so make sure we use the current master key.
+	masterKeys, err := srv.getMasterKeys()
+	if err != nil {
+		// The server has been locked again.
+		return nil
+	}
+	return errgo.Mask(srv.finishRekey(masterKeys[0]))
+}
+
+// checkPassword0 is the internal version of checkPassword.
+// It reports whether the server was unlocked by the call.
+func (srv *server) checkPassword0(password string) (bool, error) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	if srv.encryptedMasterKey == nil {
-		return errgo.Newf("no password set yet")
+		return false, errgo.Newf("no password set yet")
 	}
 	masterKey, err := decrypt(srv.encryptedMasterKey, password)
 	if err != nil {
-		return errgo.Mask(err)
+		return false, errgo.Mask(err)
 	}
-	if srv.masterKey == nil {
-		srv.masterKey = masterKey
-	} else {
+	if srv.masterKey != nil {
 		// Sanity check that the decrypted key is the same as
 		// the one we already have.
 		if !bytes.Equal(masterKey, srv.masterKey) {
-			return errgo.Newf("key mismatch after decryption (should never happen)")
+			return false, errgo.Newf("key mismatch after decryption (should never happen)")
 		}
+		return false, nil
 	}
-	return nil
+	srv.masterKey = masterKey
+	srv.lastUsed = time.Now()
+	return true, nil
 }
 
-func (srv *server) getMasterKey() ([]byte, error) {
+// getMasterKeys returns copies of the decrypted master keys
+// that may have been used to encrypt stored data. The first
+// is the current master key, which should be used to encrypt
+// new data. While stored data is being re-encrypted after a
+// password change, the second is the previous master key.
+//
+// It returns an error with a params.ErrLocked cause
+// if the server is locked.
+func (srv *server) getMasterKeys() ([][]byte, error) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	if srv.masterKey == nil {
-		return nil, errgo.Newf("locked - no password supplied yet")
+		return nil, errgo.WithCausef(nil, params.ErrLocked, "locked - no password supplied yet")
+	}
+	srv.lastUsed = time.Now()
+	keys := [][]byte{append([]byte(nil), srv.masterKey...)}
+	if srv.prevMasterKey != nil {
+		keys = append(keys, append([]byte(nil), srv.prevMasterKey...))
+	}
+	return keys, nil
+}
+
+// legacyRootKey returns the root key used for macaroons created
+// before root keys were stored separately.
+func (srv *server) legacyRootKey() ([]byte, error) {
+	masterKeys, err := srv.getMasterKeys()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrLocked))
+	}
+	data, err := srv.store.readFile(legacyKeyFile)
+	if err != nil {
+		if os.IsNotExist(errgo.Cause(err)) {
+			return masterKeys[0], nil
+		}
+		return nil, errgo.Notef(err, "cannot read legacy root key")
+	}
+	key, err := openWithKeys(data, masterKeys)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot decrypt legacy root key")
 	}
-	return srv.masterKey, nil
+	return key, nil
 }
 
-func (srv *server) setPassword(oldPassword, newPassword string) error {
+// lock wipes the decrypted master key and all decrypted
+// root keys from memory. The password must be provided
+// again before any root keys can be used.
+func (srv *server) lock() {
 	srv.mu.Lock()
-	defer srv.mu.Unlock()
-	return srv.setPassword0(oldPassword, newPassword)
+	wipe(srv.masterKey)
+	wipe(srv.prevMasterKey)
+	srv.masterKey = nil
+	srv.prevMasterKey = nil
+	srv.mu.Unlock()
+	srv.rootKeys.forget()
+	srv.accessKeys.forget()
+	srv.resetBakery()
+}
+
+// lockIfIdle locks the server if the master key has
+// not been used for at least the given duration.
+func (srv *server) lockIfIdle(timeout time.Duration) {
+	srv.mu.Lock()
+	idle := srv.masterKey != nil && time.Since(srv.lastUsed) >= timeout
+	srv.mu.Unlock()
+	if idle {
+		logger.Infof("locking after %v of inactivity", timeout)
+		srv.lock()
+	}
 }
 
-func (srv *server) setPassword0(oldPassword, newPassword string) error {
-	encryptedMasterKey := srv.encryptedMasterKey
-	if encryptedMasterKey == nil {
-		// We don't have a key, so generate one.
+// runIdleLocker locks the server whenever it has been
+// idle for the given duration. It never returns.
+func (srv *server) runIdleLocker(timeout time.Duration) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+		srv.lockIfIdle(timeout)
+	}
+}
+
+// setPassword changes the password that protects the master key.
+// If invalidateTokens is true, all access macaroons issued
+// so far will become invalid.
+//
+// A new master key is generated and all stored data is
+// re-encrypted with it, so that data encrypted under the
+// old password cannot be decrypted with the old master key.
+// The previous master key is kept, encrypted with the new one,
+// until the re-encryption is complete, so that it can be
+// finished after a crash.
+func (srv *server) setPassword(oldPassword, newPassword string, invalidateTokens bool) error {
+	srv.passwordMu.Lock()
+	defer srv.passwordMu.Unlock()
+	oldMasterKey, err := srv.oldMasterKey(oldPassword)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	if oldMasterKey == nil {
+		// We don't have a key yet, so there is no stored
+		// data to re-encrypt.
 		masterKey, err := randomBytes(24)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		encryptedMasterKey = encrypt(masterKey, "")
+		return srv.setMasterKey(masterKey, nil, newPassword)
+	}
+	if err := srv.finishRekey(oldMasterKey); err != nil {
+		return errgo.Mask(err)
+	}
+	if invalidateTokens {
+		if err := srv.accessKeys.removeAll(); err != nil {
+			return errgo.Notef(err, "cannot invalidate access tokens")
+		}
 	}
-	masterKey, err := decrypt(encryptedMasterKey, oldPassword)
+	if err := srv.saveLegacyRootKey(oldMasterKey); err != nil {
+		return errgo.Mask(err)
+	}
+	masterKey, err := randomBytes(24)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	// Re-encrypt with new password and write it.
-	encryptedMasterKey = encrypt(masterKey, newPassword)
-	if err := srv.writeEncryptedKey(encryptedMasterKey); err == nil {
-		srv.masterKey = masterKey
-		srv.encryptedMasterKey = encryptedMasterKey
-		return nil
+	if err := srv.store.writeFile(prevMasterKeyFile, sealWithKey(oldMasterKey, masterKey)); err != nil {
+		return errgo.Notef(err, "cannot write previous master key")
 	}
-	if !os.IsExist(errgo.Cause(err)) {
+	if err := srv.setMasterKey(masterKey, oldMasterKey, newPassword); err != nil {
 		return errgo.Mask(err)
 	}
-	// The file already exists (someone must have been creating it at the same
-	// time), so try again.
-	return srv.setPassword0(oldPassword, newPassword)
+	return errgo.Mask(srv.rekey(oldMasterKey, masterKey))
 }
 
-func (srv *server) writeEncryptedKey(key []byte) error {
-	return writeFile(srv.masterKeyPath(), key)
+// oldMasterKey returns the master key decrypted with the given
+// password, or nil if no password has been set yet, in which
+// case the password must be empty.
+func (srv *server) oldMasterKey(password string) ([]byte, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.encryptedMasterKey == nil {
+		if password != "" {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "incorrect old password")
+		}
+		return nil, nil
+	}
+	key, err := decrypt(srv.encryptedMasterKey, password)
+	if err != nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "incorrect old password")
+	}
+	return key, nil
 }
 
-// readEncryptedMasterKey reads the root key and decrypts it.
-func (srv *server) readEncryptedMasterKey() error {
-	data, err := readFile(srv.masterKeyPath())
+// setMasterKey encrypts the given master key with the given
+// password, writes it and starts using it. The previous
+// master key, if any, is retained for decrypting stored data
+// until the re-encryption is complete. The master key file is
+// replaced atomically, so after a crash either the old or the
+// new password will work.
+func (srv *server) setMasterKey(masterKey, prevMasterKey []byte, password string) error {
+	// Note that this always uses the latest encryption format,
+	// so any master key file in an older format is upgraded.
+	encryptedMasterKey, err := encrypt(masterKey, password)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	srv.encryptedMasterKey = data
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err := srv.writeEncryptedMasterKey(encryptedMasterKey); err != nil {
+		return errgo.Mask(err)
+	}
+	wipe(srv.masterKey)
+	srv.masterKey = append([]byte(nil), masterKey...)
+	srv.prevMasterKey = append([]byte(nil), prevMasterKey...)
+	srv.lastUsed = time.Now()
+	srv.encryptedMasterKey = encryptedMasterKey
 	return nil
 }
 
-func (srv *server) masterKeyPath() string {
-	return filepath.Join(srv.dir, "masterkey")
+// saveLegacyRootKey stores the given master key as the legacy root
+// key if no legacy root key has been stored yet, so that legacy
+// macaroons remain valid when the master key is replaced.
+// Called with srv.passwordMu held.
+func (srv *server) saveLegacyRootKey(masterKey []byte) error {
+	_, err := srv.store.readFile(legacyKeyFile)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(errgo.Cause(err)) {
+		return errgo.Notef(err, "cannot read legacy root key")
+	}
+	if err := srv.store.writeFile(legacyKeyFile, sealWithKey(masterKey, masterKey)); err != nil {
+		return errgo.Notef(err, "cannot write legacy root key")
+	}
+	return nil
 }
 
-func writeFile(path string, data []byte) error {
-	// TODO write file atomically
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_EXCL|os.O_SYNC|os.O_CREATE, 0600)
+// finishRekey completes the re-encryption of stored data
+// if a previous password change was interrupted. The given
+// master key is the current one.
+// Called with srv.passwordMu held.
+func (srv *server) finishRekey(masterKey []byte) error {
+	data, err := srv.store.readFile(prevMasterKeyFile)
 	if err != nil {
-		return errgo.Mask(err, os.IsExist)
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil
+		}
+		return errgo.Notef(err, "cannot read previous master key")
 	}
-	defer f.Close()
-	if _, err := f.Write([]byte(base64.RawStdEncoding.EncodeToString(data))); err != nil {
+	prevMasterKey, err := openWithKey(data, masterKey)
+	if err != nil {
+		// The password change was interrupted before
+		// the new master key was written, so nothing
+		// has been re-encrypted.
+		logger.Infof("removing unused previous master key")
+		return errgo.Mask(srv.store.remove(prevMasterKeyFile))
+	}
+	logger.Infof("completing interrupted re-encryption of stored keys")
+	srv.mu.Lock()
+	if srv.masterKey != nil {
+		srv.prevMasterKey = append([]byte(nil), prevMasterKey...)
+	}
+	srv.mu.Unlock()
+	return errgo.Mask(srv.rekey(prevMasterKey, masterKey))
+}
+
+// rekey re-encrypts all the stored data that is encrypted
+// with oldMasterKey so that it is encrypted with masterKey.
+// Called with srv.passwordMu held.
+func (srv *server) rekey(oldMasterKey, masterKey []byte) error {
+	if err := srv.rootKeys.rekey(oldMasterKey, masterKey); err != nil {
+		return errgo.Notef(err, "cannot re-encrypt root keys")
+	}
+	if err := srv.accessKeys.rekey(oldMasterKey, masterKey); err != nil {
+		return errgo.Notef(err, "cannot re-encrypt access root keys")
+	}
+	if err := srv.rekeyKeyPair(keyPairFile, oldMasterKey, masterKey); err != nil {
+		return errgo.Notef(err, "cannot re-encrypt key pair")
+	}
+	if err := srv.rekeyKeyPair(bakeryKeyFile, oldMasterKey, masterKey); err != nil {
+		return errgo.Notef(err, "cannot re-encrypt bakery key")
+	}
+	if err := srv.rekeyFile(legacyKeyFile, oldMasterKey, masterKey); err != nil {
+		return errgo.Notef(err, "cannot re-encrypt legacy root key")
+	}
+	if err := srv.store.remove(prevMasterKeyFile); err != nil {
+		return errgo.Notef(err, "cannot remove previous master key")
+	}
+	srv.mu.Lock()
+	wipe(srv.prevMasterKey)
+	srv.prevMasterKey = nil
+	srv.mu.Unlock()
+	return nil
+}
+
+// rekeyFile re-encrypts the file with the given name, which holds
+// data encrypted with sealWithKey, so that it is encrypted with
+// masterKey. It does nothing if the file does not exist.
+func (srv *server) rekeyFile(name string, oldMasterKey, masterKey []byte) error {
+	data, err := srv.store.readFile(name)
+	if err != nil {
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil
+		}
 		return errgo.Mask(err)
 	}
+	data, changed, err := resealWithKey(data, oldMasterKey, masterKey)
+	if err != nil || !changed {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(srv.store.writeFile(name, data))
+}
+
+// writeEncryptedMasterKey atomically writes the encrypted master key.
+func (srv *server) writeEncryptedMasterKey(key []byte) error {
+	data := base64.RawStdEncoding.EncodeToString(key)
+	if err := srv.store.writeFile(masterKeyFile, []byte(data)); err != nil {
+		return errgo.Notef(err, "cannot write master key")
+	}
 	return nil
 }
 
-// readFile reads the contents of the given file.
-// It returns nil if the file does not exist.
-func readFile(path string) ([]byte, error) {
-	data, err := ioutil.ReadFile(path)
+// readEncryptedMasterKey reads the encrypted master key
+// into srv.encryptedMasterKey. If there is no master key file,
+// srv.encryptedMasterKey is left as nil.
+func (srv *server) readEncryptedMasterKey() error {
+	data, err := srv.store.readFile(masterKeyFile)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, errgo.Mask(err)
+		if os.IsNotExist(errgo.Cause(err)) {
+			return nil
 		}
-		return nil, nil
+		return errgo.Mask(err)
 	}
-	data = bytes.TrimSpace(data)
-	data, err = macaroon.Base64Decode(data)
+	data, err = macaroon.Base64Decode(bytes.TrimSpace(data))
 	if err != nil {
-		return nil, errgo.Notef(err, "invalid root key contents")
+		return errgo.Notef(err, "invalid master key contents")
+	}
+	srv.encryptedMasterKey = data
+	return nil
+}
+
+// runSweeper periodically removes expired root keys
+// and operations.
+// It never returns.
+func (srv *server) runSweeper(interval time.Duration) {
+	for {
+		if err := srv.rootKeys.removeExpired(); err != nil {
+			logger.Errorf("cannot remove expired root keys: %v", err)
+		}
+		if err := srv.accessKeys.removeExpired(); err != nil {
+			logger.Errorf("cannot remove expired access root keys: %v", err)
+		}
+		if err := srv.ops.removeExpired(); err != nil {
+			logger.Errorf("cannot remove expired operations: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// wipe overwrites the given data with zeros.
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
 	}
-	return data, nil
 }
 
 func randomBytes(n int) ([]byte, error) {
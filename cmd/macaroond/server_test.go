@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+// newTestServer returns a server that uses the storage
+// directory at the given path. The storage should be closed
+// after use.
+func newTestServer(c *qt.C, dir string) *server {
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	for _, dir := range []string{rootKeyDir, accessKeyDir, opsDir} {
+		err := st.mkdir(dir)
+		c.Assert(err, qt.Equals, nil)
+	}
+	srv := &server{
+		store: st,
+	}
+	srv.rootKeys = newRootKeyStore(srv, st, rootKeyDir, time.Hour)
+	srv.accessKeys = newRootKeyStore(srv, st, accessKeyDir, time.Hour)
+	srv.ops = newOpsStore(st, opsDir)
+	err = srv.readEncryptedMasterKey()
+	c.Assert(err, qt.Equals, nil)
+	return srv
+}
+
+func TestSetPassword(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	c.Assert(srv.needsPassword(), qt.Equals, true)
+
+	// The initial password must be set with an empty old password.
+	err = srv.setPassword("wrong", "pw1", false)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	err = srv.setPassword("", "pw1", false)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.needsPassword(), qt.Equals, false)
+	oldMasterKey := append([]byte(nil), srv.masterKey...)
+
+	rootKey, err := srv.rootKeys.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	accessKey, err := srv.accessKeys.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	keyPair, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	bakeryKey, err := srv.bakeryKey()
+	c.Assert(err, qt.Equals, nil)
+
+	err = srv.setPassword("wrong", "pw2", false)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	err = srv.setPassword("pw1", "pw2", false)
+	c.Assert(err, qt.Equals, nil)
+
+	// The stored keys are no longer encrypted with the old master key.
+	var stored storedRootKey
+	err = srv.store.readJSON(srv.rootKeys.keyPath(rootKey.id), &stored)
+	c.Assert(err, qt.Equals, nil)
+	_, err = openWithKey(stored.EncryptedKey, oldMasterKey)
+	c.Assert(err, qt.ErrorMatches, `cannot decrypt data`)
+	_, err = srv.store.readFile(prevMasterKeyFile)
+	c.Assert(os.IsNotExist(errgo.Cause(err)), qt.Equals, true)
+	srv.store.Close()
+
+	// After a restart, only the new password works and all
+	// the keys can still be used.
+	srv = newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.checkPassword("pw1")
+	c.Assert(err, qt.ErrorMatches, `bad password "pw1"`)
+	err = srv.checkPassword("pw2")
+	c.Assert(err, qt.Equals, nil)
+
+	rootKey1, err := srv.rootKeys.findKey(rootKey.id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(rootKey1.key), qt.Equals, string(rootKey.key))
+	accessKey1, err := srv.accessKeys.findKey(accessKey.id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(accessKey1.key), qt.Equals, string(accessKey.key))
+	keyPair1, err := srv.keyPair()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*keyPair1, qt.Equals, *keyPair)
+	bakeryKey1, err := srv.bakeryKey()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*bakeryKey1, qt.Equals, *bakeryKey)
+
+	// Legacy macaroons still use the original master key.
+	legacyKey, err := srv.legacyRootKey()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(legacyKey), qt.Equals, string(oldMasterKey))
+}
+
+func TestSetPasswordInvalidateTokens(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.setPassword("", "pw1", false)
+	c.Assert(err, qt.Equals, nil)
+	rootKey, err := srv.rootKeys.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	accessKey, err := srv.accessKeys.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = srv.setPassword("pw1", "pw2", true)
+	c.Assert(err, qt.Equals, nil)
+
+	// The access root keys have gone but the other
+	// root keys remain.
+	_, err = srv.accessKeys.findKey(accessKey.id)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+	_, err = srv.rootKeys.findKey(rootKey.id)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestSetPasswordRecovery(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(c, dir)
+	err = srv.setPassword("", "pw1", false)
+	c.Assert(err, qt.Equals, nil)
+	rootKey, err := srv.rootKeys.newKey(time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Simulate a crash after the new master key has been
+	// written but before the root keys have been re-encrypted.
+	oldMasterKey := append([]byte(nil), srv.masterKey...)
+	masterKey, err := randomBytes(24)
+	c.Assert(err, qt.Equals, nil)
+	err = srv.store.writeFile(prevMasterKeyFile, sealWithKey(oldMasterKey, masterKey))
+	c.Assert(err, qt.Equals, nil)
+	err = srv.setMasterKey(masterKey, nil, "pw2")
+	c.Assert(err, qt.Equals, nil)
+	srv.store.Close()
+
+	// The re-encryption is completed when the server is unlocked.
+	srv = newTestServer(c, dir)
+	defer srv.store.Close()
+	err = srv.checkPassword("pw2")
+	c.Assert(err, qt.Equals, nil)
+	_, err = srv.store.readFile(prevMasterKeyFile)
+	c.Assert(os.IsNotExist(errgo.Cause(err)), qt.Equals, true)
+	var stored storedRootKey
+	err = srv.store.readJSON(srv.rootKeys.keyPath(rootKey.id), &stored)
+	c.Assert(err, qt.Equals, nil)
+	_, err = openWithKey(stored.EncryptedKey, masterKey)
+	c.Assert(err, qt.Equals, nil)
+	rootKey1, err := srv.rootKeys.findKey(rootKey.id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(rootKey1.key), qt.Equals, string(rootKey.key))
+
+	// A previous master key left by a password change that
+	// failed before the new master key was written is removed.
+	otherKey, err := randomBytes(24)
+	c.Assert(err, qt.Equals, nil)
+	err = srv.store.writeFile(prevMasterKeyFile, sealWithKey(masterKey, otherKey))
+	c.Assert(err, qt.Equals, nil)
+	err = srv.setPassword("pw2", "pw3", false)
+	c.Assert(err, qt.Equals, nil)
+	_, err = srv.rootKeys.findKey(rootKey.id)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestPeerPermitted(t *testing.T) {
+	c := qt.New(t)
+	srv := &server{
+		allowedUids: map[int]bool{
+			os.Getuid() + 1: true,
+		},
+	}
+	ctxFor := func(uid int) context.Context {
+		return context.WithValue(context.Background(), peerUidKey{}, uid)
+	}
+	// Without a shared socket, the socket permissions
+	// keep other users out.
+	c.Assert(srv.peerPermitted(context.Background()), qt.Equals, true)
+
+	srv.sharedSocket = true
+	c.Assert(srv.peerPermitted(ctxFor(os.Getuid())), qt.Equals, true)
+	c.Assert(srv.peerPermitted(ctxFor(os.Getuid()+1)), qt.Equals, true)
+	c.Assert(srv.peerPermitted(ctxFor(os.Getuid()+2)), qt.Equals, false)
+	c.Assert(srv.peerPermitted(context.Background()), qt.Equals, false)
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// listenUnix listens on the unix socket at the given path. The
+// socket is created so that only the current user can connect
+// to it, unless shared is true, in which case any user that can
+// reach the socket's directory can connect to it, and the server
+// must check the peer credentials of each connection.
+// A socket left behind by a previous server is removed,
+// but it is an error if another server is still listening on it.
+func listenUnix(path string, shared bool) (net.Listener, error) {
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errgo.Newf("another server is already listening on %q", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errgo.Notef(err, "cannot remove stale socket")
+		}
+	}
+	// Set the umask so that the socket never exists
+	// with permissions that are too open.
+	mask := 0177
+	if shared {
+		mask = 0111
+	}
+	oldMask := syscall.Umask(mask)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return listener, nil
+}
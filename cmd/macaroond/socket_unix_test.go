@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestListenUnixPermissions(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		shared bool
+		expect os.FileMode
+	}{{
+		shared: false,
+		expect: 0600,
+	}, {
+		shared: true,
+		expect: 0666,
+	}} {
+		path := filepath.Join(dir, "sock")
+		listener, err := listenUnix(path, test.shared)
+		c.Assert(err, qt.Equals, nil)
+		info, err := os.Stat(path)
+		c.Assert(err, qt.Equals, nil)
+		c.Check(info.Mode().Perm(), qt.Equals, test.expect, qt.Commentf("shared %v", test.shared))
+		listener.Close()
+	}
+}
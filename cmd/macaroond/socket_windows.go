@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+	"runtime"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// listenUnix listens on the unix socket at the given path.
+// Unix sockets are not supported on this platform.
+func listenUnix(path string, shared bool) (net.Listener, error) {
+	return nil, errgo.Newf("unix sockets not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// storageFormatVersion holds the version of the on-disk format
+// of the storage directory. It is recorded in the format file
+// and should be incremented whenever an incompatible change is
+// made to the layout or contents of the directory.
+const storageFormatVersion = 1
+
+const (
+	formatFileName = "format"
+	lockFileName   = "lock"
+)
+
+// storage provides access to the files inside a macaroond
+// storage directory. All writes are atomic - a reader will
+// see either the old contents of a file or the new contents,
+// even if the server crashes.
+//
+// The directory is locked while the storage is open, so that
+// two macaroond processes cannot use the same directory
+// at once.
+type storage struct {
+	dir  string
+	lock *os.File
+}
+
+// openStorage opens the storage directory at the given path,
+// creating it if needed. The returned storage should be
+// closed after use.
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errgo.Notef(err, "cannot create storage directory")
+	}
+	lock, err := lockDir(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot lock storage directory %q", dir)
+	}
+	s := &storage{
+		dir:  dir,
+		lock: lock,
+	}
+	if err := s.checkFormat(); err != nil {
+		s.Close()
+		return nil, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+// Close closes the storage, releasing its lock.
+func (s *storage) Close() error {
+	return s.lock.Close()
+}
+
+// checkFormat checks that the storage directory is in a format
+// that we understand, and records the format if the
+// directory has not been used before.
+func (s *storage) checkFormat() error {
+	data, err := s.readFile(formatFileName)
+	if err != nil {
+		if !os.IsNotExist(errgo.Cause(err)) {
+			return errgo.Mask(err)
+		}
+		// Directories created before the format file existed
+		// have a compatible layout, so we can just record
+		// the current version.
+		return s.writeFile(formatFileName, []byte(strconv.Itoa(storageFormatVersion)+"\n"))
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return errgo.Newf("invalid storage format file %q", s.path(formatFileName))
+	}
+	if version != storageFormatVersion {
+		return errgo.Newf("storage directory has unsupported format version %d (want %d)", version, storageFormatVersion)
+	}
+	return nil
+}
+
+// path returns the file system path of the file
+// with the given name, relative to the storage directory.
+func (s *storage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// mkdir creates the directory with the given name
+// if it does not already exist.
+func (s *storage) mkdir(name string) error {
+	if err := os.MkdirAll(s.path(name), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// readFile reads the file with the given name. If the file does
+// not exist, it returns an error satisfying os.IsNotExist.
+func (s *storage) readFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	return data, nil
+}
+
+// writeFile atomically writes the given data to the file with the
+// given name, replacing any existing file. When it returns
+// successfully, the data has been flushed to stable storage.
+func (s *storage) writeFile(name string, data []byte) error {
+	path := s.path(name)
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := syncDir(dir); err != nil {
+		return errgo.Notef(err, "cannot sync directory")
+	}
+	return nil
+}
+
+// readJSON reads the JSON-encoded contents of the
+// file with the given name into v.
+func (s *storage) readJSON(name string, v interface{}) error {
+	data, err := s.readFile(name)
+	if err != nil {
+		return errgo.Mask(err, os.IsNotExist)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errgo.Notef(err, "invalid contents of %q", name)
+	}
+	return nil
+}
+
+// writeJSON atomically writes the JSON encoding of v
+// to the file with the given name.
+func (s *storage) writeJSON(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return s.writeFile(name, data)
+}
+
+// remove removes the file with the given name.
+// It is not an error if the file does not exist.
+func (s *storage) remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	return syncDir(filepath.Dir(s.path(name)))
+}
+
+// list returns the names of all the files in the directory
+// with the given name, excluding any temporary files.
+func (s *storage) list(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
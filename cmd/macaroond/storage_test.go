@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStorageWriteFile(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(filepath.Join(dir, "storage"))
+	c.Assert(err, qt.Equals, nil)
+	defer st.Close()
+
+	err = st.writeFile("x", []byte("hello"))
+	c.Assert(err, qt.Equals, nil)
+	// Writing again overwrites the file.
+	err = st.writeFile("x", []byte("goodbye"))
+	c.Assert(err, qt.Equals, nil)
+	data, err := st.readFile("x")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, "goodbye")
+
+	names, err := st.list("")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(names, qt.DeepEquals, []string{formatFileName, lockFileName, "x"})
+}
+
+func TestStorageLocked(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	st, err := openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	_, err = openStorage(dir)
+	c.Assert(err, qt.ErrorMatches, `cannot lock storage directory ".*": directory is in use by another macaroond process`)
+
+	// When the storage is closed, the directory can be used again.
+	st.Close()
+	st, err = openStorage(dir)
+	c.Assert(err, qt.Equals, nil)
+	st.Close()
+}
+
+func TestStorageBadFormat(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "macaroond-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, formatFileName), []byte("99\n"), 0600)
+	c.Assert(err, qt.Equals, nil)
+	_, err = openStorage(dir)
+	c.Assert(err, qt.ErrorMatches, `storage directory has unsupported format version 99 \(want 1\)`)
+}
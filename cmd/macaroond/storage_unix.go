@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// syncDir flushes the directory entries of the given
+// directory to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
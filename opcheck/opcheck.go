@@ -0,0 +1,213 @@
+// Package opcheck checks whether macaroons allow operations. It is
+// used by both macaroond and the macaroon command, so that macaroons
+// are checked in the same way whether their root keys are held by
+// the server or in a local file.
+package opcheck
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+	"github.com/rogpeppe/macaroon-cmd/policy"
+)
+
+// CheckOps checks whether the given macaroons allow all the given
+// operations, using store to verify them. Caveat conditions are
+// resolved with the given namespace, which may be nil, and the
+// conditions named by the given policy, which may also be nil, are
+// checked against it. The context can hold information about the
+// request, as added by params.ContextWithCheckContext.
+//
+// Conditions that aren't recognized are returned in the response
+// for the caller to check. If the operations are not allowed,
+// CheckOps returns an error with a params.ErrVerificationFailed cause.
+func CheckOps(ctx context.Context, store bakery.MacaroonOpStore, mss []macaroon.Slice, ops []bakery.Op, ns *checkers.Namespace, pol *policy.Policy) (*params.CheckMacaroonResponse, error) {
+	checker, fpChecker := newAuthChecker(store, mss, ns, pol)
+	authInfo, err := checker.Allow(ctx, ops...)
+	if err != nil {
+		if _, ok := errgo.Cause(err).(*bakery.DischargeRequiredError); ok || errgo.Cause(err) == bakery.ErrPermissionDenied {
+			return nil, errgo.WithCausef(err, params.ErrVerificationFailed, "")
+		}
+		return nil, errgo.Notef(err, "cannot check macaroons")
+	}
+	conditions := authInfo.Conditions()
+	return &params.CheckMacaroonResponse{
+		Conditions:        conditions,
+		UnknownConditions: filterConditions(fpChecker.unknownConditions, conditions),
+		Declared:          checkers.InferDeclaredFromConditions(fpChecker.Namespace(), conditions),
+	}, nil
+}
+
+// CheckEachOp is like CheckOps except that it checks each operation
+// separately and returns the status of each one. The conditions in
+// the macaroons are checked only once. It does not return an error
+// when operations are not allowed.
+func CheckEachOp(ctx context.Context, store bakery.MacaroonOpStore, mss []macaroon.Slice, ops []bakery.Op, ns *checkers.Namespace, pol *policy.Policy) ([]params.OpStatus, error) {
+	checker, fpChecker := newAuthChecker(store, mss, ns, pol)
+	authInfo, err := checker.Allowed(ctx)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot check macaroons")
+	}
+	var d *denials
+	statuses := make([]params.OpStatus, len(ops))
+	for i, op := range ops {
+		statuses[i].Op = op
+		mindex, ok := authInfo.OpIndexes[op]
+		if !ok {
+			if d == nil {
+				// Only find out why operations were denied
+				// when we need to, as it means checking each
+				// macaroon slice again.
+				d, err = findDenials(ctx, store, mss, ns, pol)
+				if err != nil {
+					return nil, errgo.Mask(err)
+				}
+			}
+			statuses[i].Error = d.reason(op)
+			continue
+		}
+		conditions := macaroonConditions(authInfo, mindex)
+		statuses[i].Allowed = true
+		statuses[i].Conditions = conditions
+		statuses[i].UnknownConditions = filterConditions(fpChecker.unknownConditions, conditions)
+		statuses[i].Declared = checkers.InferDeclaredFromConditions(fpChecker.Namespace(), conditions)
+	}
+	return statuses, nil
+}
+
+// denials holds the reasons that each macaroon slice
+// did not allow the operations associated with it.
+type denials struct {
+	// ops holds the operations associated with each
+	// slice, or nil if the slice could not be verified.
+	ops [][]bakery.Op
+
+	// errs holds the first condition that failed
+	// in each slice, if any.
+	errs []error
+}
+
+// findDenials checks each of the given macaroon slices on its own,
+// so that the reason that an operation was not allowed can be found
+// from the slices that are associated with the operation.
+func findDenials(ctx context.Context, store bakery.MacaroonOpStore, mss []macaroon.Slice, ns *checkers.Namespace, pol *policy.Policy) (*denials, error) {
+	d := &denials{
+		ops:  make([][]bakery.Op, len(mss)),
+		errs: make([]error, len(mss)),
+	}
+	for i, ms := range mss {
+		ops, _, err := store.MacaroonOps(ctx, ms)
+		if err != nil {
+			if _, ok := errgo.Cause(err).(*bakery.VerificationError); ok {
+				continue
+			}
+			return nil, errgo.Notef(err, "cannot check macaroons")
+		}
+		checker, fpChecker := newAuthChecker(store, []macaroon.Slice{ms}, ns, pol)
+		if _, err := checker.Allowed(ctx); err != nil {
+			return nil, errgo.Notef(err, "cannot check macaroons")
+		}
+		d.ops[i] = ops
+		d.errs[i] = fpChecker.err
+	}
+	return d, nil
+}
+
+// reason returns the reason that the given operation was not
+// allowed, in the same form as the error returned by
+// bakery.AuthChecker.Allow. This is the first condition that failed
+// in a macaroon slice associated with the operation.
+func (d *denials) reason(op bakery.Op) string {
+	for i, ops := range d.ops {
+		if d.errs[i] == nil {
+			continue
+		}
+		for _, sliceOp := range ops {
+			if sliceOp == op {
+				return d.errs[i].Error()
+			}
+		}
+	}
+	return bakery.ErrPermissionDenied.Error()
+}
+
+// newAuthChecker returns a checker for the given macaroons
+// and the first party caveat checker that it uses.
+func newAuthChecker(store bakery.MacaroonOpStore, mss []macaroon.Slice, ns *checkers.Namespace, pol *policy.Policy) (*bakery.AuthChecker, *conditionCollector) {
+	fpChecker := &conditionCollector{
+		underlying: pol.Checker(newChecker(ns)),
+	}
+	checker := bakery.NewChecker(bakery.CheckerParams{
+		MacaroonOpStore: store,
+		Checker:         fpChecker,
+	}).Auth(mss...)
+	return checker, fpChecker
+}
+
+// newChecker returns a checker that checks the standard
+// and HTTP caveats, resolving conditions with the given
+// namespace, which may be nil.
+func newChecker(ns *checkers.Namespace) *checkers.Checker {
+	c := checkers.New(ns)
+	httpbakery.RegisterCheckers(c)
+	return c
+}
+
+// macaroonConditions returns the first party caveat conditions
+// of the macaroon with the given index in info.
+func macaroonConditions(info *bakery.AuthInfo, index int) []string {
+	used := make([]bool, len(info.Macaroons))
+	used[index] = true
+	return (&bakery.AuthInfo{
+		Macaroons: info.Macaroons,
+		Used:      used,
+	}).Conditions()
+}
+
+// filterConditions returns the elements of conds that
+// are also in the given conditions, without duplicates.
+func filterConditions(conds, conditions []string) []string {
+	found := make(map[string]bool)
+	for _, cond := range conditions {
+		found[cond] = true
+	}
+	var filtered []string
+	for _, cond := range conds {
+		if found[cond] {
+			filtered = append(filtered, cond)
+			found[cond] = false
+		}
+	}
+	return filtered
+}
+
+// conditionCollector wraps a bakery.FirstPartyCaveatChecker by
+// recording any unrecognized conditions instead of failing.
+// It also records the first condition that fails.
+type conditionCollector struct {
+	unknownConditions []string
+	underlying        bakery.FirstPartyCaveatChecker
+	err               error
+}
+
+func (c *conditionCollector) CheckFirstPartyCaveat(ctx context.Context, cav string) error {
+	err := c.underlying.CheckFirstPartyCaveat(ctx, cav)
+	if errgo.Cause(err) == checkers.ErrCaveatNotRecognized {
+		c.unknownConditions = append(c.unknownConditions, cav)
+		return nil
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+func (c *conditionCollector) Namespace() *checkers.Namespace {
+	return c.underlying.Namespace()
+}
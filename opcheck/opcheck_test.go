@@ -0,0 +1,98 @@
+package opcheck
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/params"
+)
+
+var (
+	readOp = bakery.Op{
+		Entity: "x",
+		Action: "read",
+	}
+	writeOp = bakery.Op{
+		Entity: "x",
+		Action: "write",
+	}
+	deleteOp = bakery.Op{
+		Entity: "x",
+		Action: "delete",
+	}
+	otherOp = bakery.Op{
+		Entity: "y",
+		Action: "read",
+	}
+)
+
+func newTestOven() *bakery.Oven {
+	rks := bakery.NewMemRootKeyStore()
+	return bakery.NewOven(bakery.OvenParams{
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return rks
+		},
+	})
+}
+
+func newSlice(c *qt.C, oven *bakery.Oven, caveats []checkers.Caveat, op bakery.Op) macaroon.Slice {
+	m, err := oven.NewMacaroon(context.Background(), bakery.LatestVersion, time.Now().Add(time.Hour), caveats, op)
+	c.Assert(err, qt.Equals, nil)
+	return macaroon.Slice{m.M()}
+}
+
+func TestCheckOps(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	oven := newTestOven()
+	mss := []macaroon.Slice{
+		newSlice(c, oven, []checkers.Caveat{{Condition: "unknown-condition"}}, readOp),
+		newSlice(c, oven, []checkers.Caveat{checkers.DeclaredCaveat("user", "bob")}, writeOp),
+	}
+
+	resp, err := CheckOps(ctx, oven, mss, []bakery.Op{readOp, writeOp}, nil, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.UnknownConditions, qt.DeepEquals, []string{"unknown-condition"})
+	c.Assert(resp.Declared, qt.DeepEquals, map[string]string{"user": "bob"})
+
+	_, err = CheckOps(ctx, oven, mss, []bakery.Op{readOp, otherOp}, nil, nil)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrVerificationFailed)
+}
+
+func TestCheckEachOp(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	oven := newTestOven()
+	mss := []macaroon.Slice{
+		newSlice(c, oven, []checkers.Caveat{checkers.ErrorCaveatf("first failure")}, readOp),
+		newSlice(c, oven, []checkers.Caveat{checkers.ErrorCaveatf("second failure")}, writeOp),
+		newSlice(c, oven, []checkers.Caveat{checkers.DeclaredCaveat("user", "bob")}, deleteOp),
+	}
+
+	statuses, err := CheckEachOp(ctx, oven, mss, []bakery.Op{readOp, writeOp, deleteOp, otherOp}, nil, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(statuses, qt.HasLen, 4)
+
+	// Each denied operation reports the failure of
+	// the macaroon associated with it.
+	c.Assert(statuses[0].Allowed, qt.Equals, false)
+	c.Assert(statuses[0].Error, qt.Matches, `caveat "error first failure" not satisfied: .*`)
+	c.Assert(statuses[1].Allowed, qt.Equals, false)
+	c.Assert(statuses[1].Error, qt.Matches, `caveat "error second failure" not satisfied: .*`)
+
+	c.Assert(statuses[2].Allowed, qt.Equals, true)
+	c.Assert(statuses[2].Error, qt.Equals, "")
+	c.Assert(statuses[2].Declared, qt.DeepEquals, map[string]string{"user": "bob"})
+
+	// An operation that no macaroon is associated
+	// with is simply not allowed.
+	c.Assert(statuses[3].Allowed, qt.Equals, false)
+	c.Assert(statuses[3].Error, qt.Equals, bakery.ErrPermissionDenied.Error())
+}
@@ -21,6 +21,8 @@ const (
 	ErrInitialPasswordNeeded ErrorCode = "initial password needed"
 	ErrBadRequest            ErrorCode = "bad request"
 	ErrUnauthorized          ErrorCode = "unauthorized"
+	ErrLocked                ErrorCode = "locked"
+	ErrVerificationFailed    ErrorCode = "verification failed"
 )
 
 // Error represents an error - it is returned for any response that fails.
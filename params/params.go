@@ -1,8 +1,18 @@
 package params
 
 import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
 	"github.com/juju/httprequest"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	macaroon "gopkg.in/macaroon.v2-unstable"
+
+	"github.com/rogpeppe/macaroon-cmd/policy"
 )
 
 const (
@@ -21,6 +31,11 @@ type FindRootKeyResponse struct {
 
 type NewRootKeyRequest struct {
 	httprequest.Route `httprequest:"POST /key"`
+	// Expiry holds the time that the longest-lived macaroon
+	// created with the new root key will expire. The root key
+	// will be removed some time after this. If it is zero,
+	// a default expiry will be chosen by the server.
+	Expiry time.Time `httprequest:"expiry,form"`
 }
 
 type NewRootKeyResponse struct {
@@ -28,9 +43,46 @@ type NewRootKeyResponse struct {
 	RootKey []byte `json:"rootKey"`
 }
 
+// Operations that can be requested in AccessRequest.Ops.
+const (
+	// OpAccess allows access to all endpoints.
+	OpAccess = "global:access"
+
+	// OpKeyRead allows existing root keys to be retrieved,
+	// and hence macaroons to be verified and forged.
+	OpKeyRead = "key:read"
+
+	// OpMacaroonCheck allows macaroons to be verified and
+	// checked by the server, without revealing any root keys.
+	OpMacaroonCheck = "macaroon:check"
+
+	// OpKeyNew allows new root keys to be created,
+	// and hence macaroons to be minted.
+	OpKeyNew = "key:new"
+
+	// OpLock allows the server to be locked.
+	OpLock = "server:lock"
+
+	// OpKeyPairRead allows the stored key pair to be retrieved.
+	OpKeyPairRead = "keypair:read"
+
+	// OpKeyPairWrite allows the stored key pair to be replaced.
+	OpKeyPairWrite = "keypair:write"
+)
+
 type AccessRequest struct {
 	httprequest.Route `httprequest:"POST /macaroon"`
 	Password          string `httprequest:"password,form"`
+
+	// LifetimeSeconds holds the requested lifetime of the access
+	// macaroon in seconds. If it is zero or greater than the
+	// maximum allowed by the server, the maximum will be used.
+	LifetimeSeconds int64 `httprequest:"lifetime,form"`
+
+	// Ops holds the operations that the access macaroon
+	// will allow (see OpKeyRead etc). If it is empty,
+	// the macaroon will allow OpAccess.
+	Ops []string `httprequest:"ops,form"`
 }
 
 type AccessResponse struct {
@@ -41,4 +93,241 @@ type SetPasswordRequest struct {
 	httprequest.Route `httprequest:"PUT /password"`
 	OldPassword       string `httprequest:"oldPassword,form"`
 	NewPassword       string `httprequest:"newPassword,form"`
+	// InvalidateTokens specifies that all access macaroons
+	// issued before the password change should stop working.
+	InvalidateTokens bool `httprequest:"invalidateTokens,form"`
+}
+
+type LockRequest struct {
+	httprequest.Route `httprequest:"POST /lock"`
+}
+
+type UnlockRequest struct {
+	httprequest.Route `httprequest:"POST /unlock"`
+	Password          string `httprequest:"password,form"`
+}
+
+// StoreOpsRequest asks the server to store a set of
+// operations so that they can be referred to by key
+// from a macaroon id.
+type StoreOpsRequest struct {
+	httprequest.Route `httprequest:"PUT /ops"`
+	Body              StoreOpsRequestBody `httprequest:",body"`
+}
+
+type StoreOpsRequestBody struct {
+	// Key holds the key to store the operations under.
+	// It must be the entity that bakery.Oven derives from
+	// the operations.
+	Key string `json:"key"`
+
+	// Ops holds the operations to store.
+	Ops []bakery.Op `json:"ops"`
+
+	// Expiry holds the time until which the operations
+	// should be kept.
+	Expiry time.Time `json:"expiry"`
+}
+
+// FindOpsRequest asks the server for the operations
+// stored with the given key.
+type FindOpsRequest struct {
+	httprequest.Route `httprequest:"GET /ops"`
+	Key               string `httprequest:"key,form"`
+}
+
+type FindOpsResponse struct {
+	Ops []bakery.Op `json:"ops"`
+}
+
+// GetKeyPairRequest asks the server for the key pair used
+// by clients when adding third party caveats. A key pair
+// is created if there is none stored.
+type GetKeyPairRequest struct {
+	httprequest.Route `httprequest:"GET /keypair"`
+}
+
+type GetKeyPairResponse struct {
+	KeyPair *bakery.KeyPair `json:"keyPair"`
+}
+
+// SetKeyPairRequest replaces the key pair stored by the server.
+type SetKeyPairRequest struct {
+	httprequest.Route `httprequest:"PUT /keypair"`
+	Body              SetKeyPairRequestBody `httprequest:",body"`
+}
+
+type SetKeyPairRequestBody struct {
+	KeyPair *bakery.KeyPair `json:"keyPair"`
+}
+
+// MintMacaroonRequest asks the server to create a new macaroon,
+// so that the client never needs to see the root key.
+type MintMacaroonRequest struct {
+	httprequest.Route `httprequest:"POST /macaroon/new"`
+	Body              MintMacaroonRequestBody `httprequest:",body"`
+}
+
+type MintMacaroonRequestBody struct {
+	// Version holds the bakery version of the new macaroon.
+	Version bakery.Version `json:"version"`
+
+	// Expiry holds the time that the macaroon will expire.
+	Expiry time.Time `json:"expiry"`
+
+	// Caveats holds any caveats to add to the macaroon.
+	// Only first party caveats are allowed.
+	Caveats []checkers.Caveat `json:"caveats,omitempty"`
+
+	// Ops holds the operations associated with the macaroon.
+	Ops []bakery.Op `json:"ops"`
+
+	// Namespace holds the namespace to embed in the
+	// macaroon. If it is nil, the standard namespace is used.
+	Namespace *checkers.Namespace `json:"namespace,omitempty"`
+}
+
+type MintMacaroonResponse struct {
+	Macaroon *bakery.Macaroon `json:"macaroon"`
+}
+
+// VerifyMacaroonRequest asks the server to verify the signature
+// of a macaroon and return its associated operations and
+// first party caveat conditions, which are not checked.
+type VerifyMacaroonRequest struct {
+	httprequest.Route `httprequest:"POST /macaroon/ops"`
+	Body              VerifyMacaroonRequestBody `httprequest:",body"`
+}
+
+type VerifyMacaroonRequestBody struct {
+	// Macaroons holds the macaroon to verify, bound to
+	// its discharges.
+	Macaroons macaroon.Slice `json:"macaroons"`
+}
+
+type VerifyMacaroonResponse struct {
+	Ops        []bakery.Op `json:"ops"`
+	Conditions []string    `json:"conditions"`
+}
+
+// CheckMacaroonRequest asks the server to check whether the
+// given macaroons allow all the given operations, or each
+// of them if Body.Any is true.
+// Only standard and HTTP first party caveats are checked by the server.
+type CheckMacaroonRequest struct {
+	httprequest.Route `httprequest:"POST /macaroon/check"`
+	Body              CheckMacaroonRequestBody `httprequest:",body"`
+}
+
+type CheckMacaroonRequestBody struct {
+	// Macaroons holds the macaroons to check. Each
+	// element should be bound to its discharges.
+	Macaroons []macaroon.Slice `json:"macaroons"`
+
+	// Ops holds the operations to check.
+	Ops []bakery.Op `json:"ops"`
+
+	// Context holds the context to check the
+	// caveats in.
+	Context CheckContext `json:"context"`
+
+	// Namespace holds the namespace used to resolve
+	// the caveat conditions. If it is nil, the standard
+	// namespace is used.
+	Namespace *checkers.Namespace `json:"namespace,omitempty"`
+
+	// Any specifies that each operation should be checked
+	// separately. The status of each operation is returned
+	// in the Ops field of the response, and the request
+	// succeeds even if none of them are allowed.
+	Any bool `json:"any,omitempty"`
+
+	// Policy holds rules that declare the allowed arguments
+	// of custom caveat conditions. Conditions named by the
+	// rules are checked against them rather than being
+	// returned as unknown conditions.
+	Policy []policy.Rule `json:"policy,omitempty"`
+}
+
+type CheckMacaroonResponse struct {
+	// Conditions holds the first party caveat conditions
+	// of the macaroons that were used to allow the operations.
+	Conditions []string `json:"conditions,omitempty"`
+
+	// UnknownConditions holds any first party caveat conditions
+	// that the server did not recognize. It is up to the client
+	// to check them.
+	UnknownConditions []string `json:"unknownConditions,omitempty"`
+
+	// Declared holds the attributes declared by the
+	// macaroons that were used to allow the operations.
+	Declared map[string]string `json:"declared,omitempty"`
+
+	// Ops holds the status of each operation when
+	// the request's Any field is true.
+	Ops []OpStatus `json:"ops,omitempty"`
+}
+
+// OpStatus holds the result of checking a single operation.
+type OpStatus struct {
+	// Op holds the operation that was checked.
+	Op bakery.Op `json:"op"`
+
+	// Allowed holds whether the operation is allowed,
+	// subject to any unknown conditions.
+	Allowed bool `json:"allowed"`
+
+	// Error holds the reason that the operation is
+	// not allowed.
+	Error string `json:"error,omitempty"`
+
+	// Conditions, UnknownConditions and Declared hold
+	// information about the macaroons that allowed the
+	// operation, as for CheckMacaroonResponse.
+	Conditions        []string          `json:"conditions,omitempty"`
+	UnknownConditions []string          `json:"unknownConditions,omitempty"`
+	Declared          map[string]string `json:"declared,omitempty"`
+}
+
+// CheckContext holds information about the context that
+// first party caveats are checked in, as used by the standard
+// and HTTP caveat checkers.
+type CheckContext struct {
+	// Now holds the time used to check time-before caveats.
+	// If it is zero, the current time is used.
+	Now time.Time `json:"now,omitempty"`
+
+	// ClientIPAddr holds the client IP address
+	// used to check client-ip-addr caveats.
+	ClientIPAddr string `json:"clientIPAddr,omitempty"`
+
+	// Origin holds the origin used to check origin caveats.
+	Origin string `json:"origin,omitempty"`
+}
+
+// ContextWithCheckContext returns a context holding the information
+// in cc, suitable for passing to a checker created by
+// httpbakery.NewChecker.
+func ContextWithCheckContext(ctx context.Context, cc CheckContext) context.Context {
+	if !cc.Now.IsZero() {
+		ctx = checkers.ContextWithClock(ctx, fixedClock(cc.Now))
+	}
+	req := &http.Request{
+		Header: make(http.Header),
+	}
+	if cc.ClientIPAddr != "" {
+		req.RemoteAddr = net.JoinHostPort(cc.ClientIPAddr, "0")
+	}
+	if cc.Origin != "" {
+		req.Header.Set("Origin", cc.Origin)
+	}
+	return httpbakery.ContextWithRequest(ctx, req)
+}
+
+// fixedClock implements checkers.Clock by
+// always returning the same time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
 }
@@ -0,0 +1,224 @@
+// Package policy implements caveat policies, which declare the
+// allowed arguments of custom first party caveat conditions.
+package policy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"regexp"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ErrNotAllowed is used as the cause of errors returned
+// when a condition is not allowed by a policy.
+var ErrNotAllowed = errgo.New("condition not allowed by policy")
+
+// Rule holds a rule from a policy. It declares the allowed
+// arguments of a caveat condition. Exactly one of Values,
+// Regexp or CIDR must be specified.
+type Rule struct {
+	// Condition holds the name of the condition
+	// that the rule applies to.
+	Condition string `json:"condition" yaml:"condition"`
+
+	// Values holds the allowed arguments.
+	Values []string `json:"values,omitempty" yaml:"values,omitempty"`
+
+	// Regexp holds a regular expression that must
+	// match the whole argument.
+	Regexp string `json:"regexp,omitempty" yaml:"regexp,omitempty"`
+
+	// CIDR holds a set of networks. The argument,
+	// which may be an IP address or a network in CIDR
+	// notation, must lie within one of them.
+	CIDR []string `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+}
+
+// Policy holds a set of rules that declare
+// which custom caveat conditions are allowed.
+type Policy struct {
+	rules  []Rule
+	byName map[string][]*rule
+}
+
+// rule holds the compiled form of a Rule.
+type rule struct {
+	values []string
+	re     *regexp.Regexp
+	nets   []*net.IPNet
+}
+
+// New returns a policy that uses the given rules.
+func New(rules []Rule) (*Policy, error) {
+	p := &Policy{
+		rules:  rules,
+		byName: make(map[string][]*rule),
+	}
+	for i, r := range rules {
+		cr, err := compile(r)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid rule %d", i)
+		}
+		p.byName[r.Condition] = append(p.byName[r.Condition], cr)
+	}
+	return p, nil
+}
+
+// ReadFile reads a policy from the given file, which
+// holds a list of rules in YAML or JSON format.
+func ReadFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var rules []Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
+	p, err := New(rules)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return p, nil
+}
+
+// Rules returns the rules in the policy. It returns
+// nil if p is nil.
+func (p *Policy) Rules() []Rule {
+	if p == nil {
+		return nil
+	}
+	return p.rules
+}
+
+// compile checks that the rule is well formed and
+// compiles its regular expression and networks.
+func compile(r Rule) (*rule, error) {
+	if r.Condition == "" {
+		return nil, errgo.Newf("no condition")
+	}
+	var cr rule
+	n := 0
+	if len(r.Values) > 0 {
+		n++
+		cr.values = r.Values
+	}
+	if r.Regexp != "" {
+		n++
+		re, err := regexp.Compile("^(?:" + r.Regexp + ")$")
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid regexp")
+		}
+		cr.re = re
+	}
+	if len(r.CIDR) > 0 {
+		n++
+		for _, s := range r.CIDR {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			cr.nets = append(cr.nets, ipNet)
+		}
+	}
+	if n != 1 {
+		return nil, errgo.Newf("exactly one of values, regexp or cidr must be specified")
+	}
+	return &cr, nil
+}
+
+// allows reports whether the rule allows the given argument.
+func (r *rule) allows(arg string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(arg)
+	case r.nets != nil:
+		return inNets(r.nets, arg)
+	}
+	for _, v := range r.values {
+		if v == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// inNets reports whether arg, which may be an IP address
+// or a network in CIDR notation, lies within any of the
+// given networks.
+func inNets(nets []*net.IPNet, arg string) bool {
+	ip := net.ParseIP(arg)
+	var argNet *net.IPNet
+	if ip == nil {
+		var err error
+		ip, argNet, err = net.ParseCIDR(arg)
+		if err != nil {
+			return false
+		}
+	}
+	for _, n := range nets {
+		if !n.Contains(ip) {
+			continue
+		}
+		if argNet != nil {
+			// The whole of the argument network must be inside n.
+			argOnes, _ := argNet.Mask.Size()
+			ones, _ := n.Mask.Size()
+			if argOnes < ones {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Checker returns a first party caveat checker that checks
+// conditions named by the policy's rules and passes all other
+// conditions to underlying. A condition named by the policy
+// is allowed only if one of its rules allows the condition's
+// argument; otherwise the checker returns an error with an
+// ErrNotAllowed cause.
+//
+// If p is nil, underlying is returned.
+func (p *Policy) Checker(underlying bakery.FirstPartyCaveatChecker) bakery.FirstPartyCaveatChecker {
+	if p == nil {
+		return underlying
+	}
+	return &policyChecker{
+		policy:     p,
+		underlying: underlying,
+	}
+}
+
+// policyChecker implements bakery.FirstPartyCaveatChecker
+// by checking conditions against a policy.
+type policyChecker struct {
+	policy     *Policy
+	underlying bakery.FirstPartyCaveatChecker
+}
+
+// CheckFirstPartyCaveat implements bakery.FirstPartyCaveatChecker.CheckFirstPartyCaveat.
+func (c *policyChecker) CheckFirstPartyCaveat(ctx context.Context, cav string) error {
+	name, arg, err := checkers.ParseCaveat(cav)
+	rules, ok := c.policy.byName[name]
+	if err != nil || !ok {
+		return c.underlying.CheckFirstPartyCaveat(ctx, cav)
+	}
+	for _, r := range rules {
+		if r.allows(arg) {
+			return nil
+		}
+	}
+	return errgo.WithCausef(nil, ErrNotAllowed, "caveat %q not allowed by policy", cav)
+}
+
+// Namespace implements bakery.FirstPartyCaveatChecker.Namespace.
+func (c *policyChecker) Namespace() *checkers.Namespace {
+	return c.underlying.Namespace()
+}
@@ -0,0 +1,218 @@
+package policy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
+
+	"github.com/rogpeppe/macaroon-cmd/policy"
+)
+
+var newTests = []struct {
+	about       string
+	rules       []policy.Rule
+	expectError string
+}{{
+	about: "valid rules",
+	rules: []policy.Rule{{
+		Condition: "env",
+		Values:    []string{"prod"},
+	}, {
+		Condition: "user-is",
+		Regexp:    "alice|bob",
+	}, {
+		Condition: "ip-in",
+		CIDR:      []string{"10.0.0.0/8"},
+	}},
+}, {
+	about:       "no condition",
+	rules:       []policy.Rule{{Values: []string{"prod"}}},
+	expectError: `invalid rule 0: no condition`,
+}, {
+	about:       "nothing allowed",
+	rules:       []policy.Rule{{Condition: "env"}},
+	expectError: `invalid rule 0: exactly one of values, regexp or cidr must be specified`,
+}, {
+	about: "more than one kind of rule",
+	rules: []policy.Rule{{
+		Condition: "env",
+		Values:    []string{"prod"},
+		Regexp:    "prod",
+	}},
+	expectError: `invalid rule 0: exactly one of values, regexp or cidr must be specified`,
+}, {
+	about:       "invalid regexp",
+	rules:       []policy.Rule{{Condition: "env", Values: []string{"prod"}}, {Condition: "user-is", Regexp: "("}},
+	expectError: `invalid rule 1: invalid regexp: .*`,
+}, {
+	about:       "invalid network",
+	rules:       []policy.Rule{{Condition: "ip-in", CIDR: []string{"10.0.0.0"}}},
+	expectError: `invalid rule 0: invalid CIDR address: 10.0.0.0`,
+}}
+
+func TestNew(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newTests {
+		c.Run(test.about, func(c *qt.C) {
+			p, err := policy.New(test.rules)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(p.Rules(), qt.DeepEquals, test.rules)
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "policy-test")
+	c.Assert(err, qt.Equals, nil)
+	defer os.RemoveAll(dir)
+	expect := []policy.Rule{{
+		Condition: "ip-in",
+		CIDR:      []string{"10.0.0.0/8"},
+	}, {
+		Condition: "env",
+		Values:    []string{"prod", "staging"},
+	}}
+
+	path := filepath.Join(dir, "policy.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+- condition: ip-in
+  cidr: [10.0.0.0/8]
+- condition: env
+  values: [prod, staging]
+`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	p, err := policy.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Rules(), qt.DeepEquals, expect)
+
+	path = filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(path, []byte(`[
+		{"condition": "ip-in", "cidr": ["10.0.0.0/8"]},
+		{"condition": "env", "values": ["prod", "staging"]}
+	]`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	p, err = policy.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Rules(), qt.DeepEquals, expect)
+
+	err = ioutil.WriteFile(path, []byte(`[{"condition": "env"}]`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	_, err = policy.ReadFile(path)
+	c.Assert(err, qt.ErrorMatches, `invalid rule 0: exactly one of values, regexp or cidr must be specified`)
+}
+
+var checkerTests = []struct {
+	about       string
+	cond        string
+	expectError string
+}{{
+	about: "allowed value",
+	cond:  "env staging",
+}, {
+	about:       "disallowed value",
+	cond:        "env dev",
+	expectError: `caveat "env dev" not allowed by policy`,
+}, {
+	about: "regexp match",
+	cond:  "user-is bob",
+}, {
+	about:       "regexp must match the whole argument",
+	cond:        "user-is bobby",
+	expectError: `caveat "user-is bobby" not allowed by policy`,
+}, {
+	about: "address within network",
+	cond:  "ip-in 10.1.2.3",
+}, {
+	about: "address within second network",
+	cond:  "ip-in 192.168.0.1",
+}, {
+	about:       "address outside networks",
+	cond:        "ip-in 11.0.0.1",
+	expectError: `caveat "ip-in 11.0.0.1" not allowed by policy`,
+}, {
+	about: "network within network",
+	cond:  "ip-in 10.1.0.0/16",
+}, {
+	about: "network equal to network",
+	cond:  "ip-in 10.0.0.0/8",
+}, {
+	about:       "network larger than network",
+	cond:        "ip-in 10.0.0.0/7",
+	expectError: `caveat "ip-in 10.0.0.0/7" not allowed by policy`,
+}, {
+	about:       "network containing network",
+	cond:        "ip-in 192.168.0.0/16",
+	expectError: `caveat "ip-in 192.168.0.0/16" not allowed by policy`,
+}, {
+	about:       "invalid address",
+	cond:        "ip-in nowhere",
+	expectError: `caveat "ip-in nowhere" not allowed by policy`,
+}, {
+	about: "one of several rules for a condition",
+	cond:  "user-is admin",
+}, {
+	about: "standard condition",
+	cond:  "time-before 2100-01-01T00:00:00Z",
+}, {
+	about:       "unknown condition",
+	cond:        "other foo",
+	expectError: `caveat "other foo" not satisfied: caveat not recognized`,
+}}
+
+func TestChecker(t *testing.T) {
+	c := qt.New(t)
+	p, err := policy.New([]policy.Rule{{
+		Condition: "env",
+		Values:    []string{"prod", "staging"},
+	}, {
+		Condition: "user-is",
+		Regexp:    "alice|bob",
+	}, {
+		Condition: "user-is",
+		Values:    []string{"admin"},
+	}, {
+		Condition: "ip-in",
+		CIDR:      []string{"10.0.0.0/8", "192.168.0.0/24"},
+	}})
+	c.Assert(err, qt.Equals, nil)
+	underlying := checkers.New(nil)
+	checker := p.Checker(underlying)
+	c.Assert(checker.Namespace(), qt.Equals, underlying.Namespace())
+	ctx := context.Background()
+	for _, test := range checkerTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := checker.CheckFirstPartyCaveat(ctx, test.cond)
+			if test.expectError == "" {
+				c.Assert(err, qt.Equals, nil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+
+	// Denials have an ErrNotAllowed cause; unknown
+	// conditions are left for the caller to handle.
+	err = checker.CheckFirstPartyCaveat(ctx, "env dev")
+	c.Assert(errgo.Cause(err), qt.Equals, policy.ErrNotAllowed)
+	err = checker.CheckFirstPartyCaveat(ctx, "other foo")
+	c.Assert(errgo.Cause(err), qt.Equals, checkers.ErrCaveatNotRecognized)
+}
+
+func TestNilPolicy(t *testing.T) {
+	c := qt.New(t)
+	var p *policy.Policy
+	c.Assert(p.Rules(), qt.IsNil)
+	underlying := checkers.New(nil)
+	c.Assert(p.Checker(underlying), qt.Equals, underlying)
+}